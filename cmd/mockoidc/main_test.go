@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/config"
+	"github.com/1cbyc/go-websocket-server/internal/handler"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"go.uber.org/zap"
+)
+
+// newTestLogin starts the mock provider and a chat server wired to it,
+// and returns the chat server's URL along with its auth.
+func newTestLogin(t *testing.T) (string, *auth.Auth) {
+	t.Helper()
+	idp, err := newProvider("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpSrv := httptest.NewServer(idp.routes())
+	t.Cleanup(idpSrv.Close)
+	idp.issuer = idpSrv.URL
+
+	dir := t.TempDir()
+	t.Setenv("WS_DB_DSN", filepath.Join(dir, "test.db"))
+	t.Setenv("WS_BLOB_DIR", filepath.Join(dir, "blobs"))
+	t.Setenv("WS_SEARCH_LIKE", "true")
+	s := server.New(config.Load(), zap.NewNop())
+	a := auth.New("secret", time.Hour)
+	a.Users = s.Users()
+	mux := http.NewServeMux()
+	mux.Handle("/auth/oidc/login", handler.OIDCLoginHandler(s, a))
+	mux.Handle("/auth/oidc/callback", handler.OIDCCallbackHandler(s, a))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	p, err := auth.NewOIDCProvider(context.Background(), idpSrv.URL, "ws", "", srv.URL+"/auth/oidc/callback", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.OIDC = auth.NewOIDC(p)
+	return srv.URL, a
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	url, a := newTestLogin(t)
+	resp, err := newBrowser(t).Get(url + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: got %s", resp.Status)
+	}
+	var body struct {
+		Token string      `json:"token"`
+		User  *model.User `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.User == nil || body.User.Name != "alice" {
+		t.Fatalf("login: got user %+v, want alice", body.User)
+	}
+	userID, err := a.ValidateToken(body.Token)
+	if err != nil || userID != body.User.ID {
+		t.Fatalf("token: got %q, %v; want %q", userID, err, body.User.ID)
+	}
+}
+
+func TestOIDCCallbackNeedsStateCookie(t *testing.T) {
+	url, _ := newTestLogin(t)
+	// The attacker starts a login in their own browser and stops at the
+	// callback, then gets the victim's browser to open it.
+	attacker := newBrowser(t)
+	attacker.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/auth/oidc/callback" {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	resp, err := attacker.Get(url + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || callback == "" {
+		t.Fatalf("login: got %s to %q, want a redirect to the callback", resp.Status, callback)
+	}
+
+	tests := []struct {
+		name    string
+		browser *http.Client
+		want    int
+	}{
+		{"other browser", newBrowser(t), http.StatusUnauthorized},
+		{"same browser", attacker, http.StatusOK},
+		{"replayed", attacker, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		resp, err := tt.browser.Get(callback)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %s, want %d", tt.name, resp.Status, tt.want)
+		}
+	}
+}
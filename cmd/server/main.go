@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"time"
@@ -24,16 +25,59 @@ func main() {
 	}
 	expiry := 24 * time.Hour
 	a := auth.New(jwtSecret, expiry)
+	a.Users = s.Users()
+	a.APIKeys = s.APIKeys()
+	a.Logins = auth.NewLoginThrottle(cfg.LoginMaxAttempts, cfg.LoginLockout)
+	if cfg.OIDCIssuer != "" {
+		p, err := auth.NewOIDCProvider(context.Background(), cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCRedirectURL, cfg.OIDCScopes)
+		if err != nil {
+			log.Fatal("failed to init oidc provider", zap.Error(err))
+		}
+		a.OIDC = auth.NewOIDC(p)
+	}
 	r := mux.NewRouter()
+	r.Use(handler.CORS(cfg))
 	r.Handle("/ws", handler.WebSocketHandler(s, a))
-	r.Handle("/history", handler.HistoryHandler(s, a))
-	r.Handle("/presence/online", handler.PresenceOnlineHandler(s, a))
-	r.Handle("/presence/{userID}", handler.PresenceUserHandler(s, a))
-	r.Handle("/rooms", handler.RoomsHandler(s, a))
-	r.Handle("/rooms/{roomID}", handler.RoomHandler(s, a))
-	r.Handle("/rooms/{roomID}/join", handler.RoomJoinHandler(s, a))
-	r.Handle("/rooms/{roomID}/leave", handler.RoomLeaveHandler(s, a))
-	r.Handle("/rooms/{roomID}/history", handler.RoomHistoryHandler(s, a))
+	api := r.PathPrefix("/").Subrouter()
+	api.Use(handler.RateLimit(s, a))
+	api.Handle("/auth/register", handler.RegisterHandler(s, a))
+	api.Handle("/auth/login", handler.LoginHandler(s, a))
+	api.Handle("/auth/oidc/login", handler.OIDCLoginHandler(s, a))
+	api.Handle("/auth/oidc/callback", handler.OIDCCallbackHandler(s, a))
+	api.Handle("/users/{userID}", handler.UserHandler(s, a))
+	api.Handle("/users/{userID}/disabled", handler.UserDisabledHandler(s, a))
+	api.Handle("/service-accounts", handler.ServiceAccountsHandler(s, a))
+	api.Handle("/apikeys", handler.APIKeysHandler(s, a))
+	api.Handle("/apikeys/{keyID}", handler.APIKeyHandler(s, a))
+	api.Handle("/apikeys/{keyID}/rotate", handler.APIKeyRotateHandler(s, a))
+	api.Handle("/admin/connections", handler.AdminConnectionsHandler(s, a))
+	api.Handle("/admin/retention", handler.AdminRetentionHandler(s, a))
+	api.Handle("/admin/retention/{roomID}", handler.AdminRetentionHandler(s, a))
+	api.Handle("/history", handler.HistoryHandler(s, a))
+	api.Handle("/messages/{messageID}", handler.MessageHandler(s, a))
+	api.Handle("/messages/{messageID}/revisions", handler.MessageRevisionsHandler(s, a))
+	api.Handle("/scheduled", handler.ScheduledMessagesHandler(s, a))
+	api.Handle("/scheduled/{scheduledID}", handler.ScheduledMessageHandler(s, a))
+	api.Handle("/presence/online", handler.PresenceOnlineHandler(s, a))
+	api.Handle("/presence/status", handler.PresenceStatusHandler(s, a))
+	api.Handle("/presence/{userID}", handler.PresenceUserHandler(s, a))
+	api.Handle("/rooms", handler.RoomsHandler(s, a))
+	api.Handle("/rooms/{roomID}", handler.RoomHandler(s, a))
+	api.Handle("/rooms/{roomID}/join", handler.RoomJoinHandler(s, a))
+	api.Handle("/rooms/{roomID}/leave", handler.RoomLeaveHandler(s, a))
+	api.Handle("/rooms/{roomID}/restore", handler.RoomRestoreHandler(s, a))
+	api.Handle("/rooms/{roomID}/history", handler.RoomHistoryHandler(s, a))
+	api.Handle("/rooms/{roomID}/read", handler.RoomReadHandler(s, a))
+	api.Handle("/rooms/{roomID}/threads/{messageID}", handler.RoomThreadHandler(s, a))
+	api.Handle("/rooms/{roomID}/attachments", handler.RoomAttachmentsHandler(s, a))
+	api.Handle("/rooms/{roomID}/pins", handler.RoomPinsHandler(s, a))
+	api.Handle("/rooms/{roomID}/pins/{messageID}", handler.RoomPinHandler(s, a))
+	api.Handle("/attachments/{attachmentID}", handler.AttachmentHandler(s, a, false))
+	api.Handle("/attachments/{attachmentID}/thumbnail", handler.AttachmentHandler(s, a, true))
+	api.Handle("/unread", handler.UnreadHandler(s, a))
+	api.Handle("/conversations", handler.ConversationsHandler(s, a))
+	api.Handle("/mentions", handler.MentionsHandler(s, a))
+	api.Handle("/search", handler.SearchHandler(s, a))
 	log.Info("server starting", zap.String("addr", cfg.Addr))
 	http.ListenAndServe(cfg.Addr, r)
 }
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix marks a bearer token as an API key rather than a JWT.
+// Keys look like wsk_<prefix>_<secret>; only the prefix is ever shown
+// again after creation.
+const APIKeyPrefix = "wsk_"
+
+func GenerateAPIKey() (key, prefix, hash string, err error) {
+	p := make([]byte, 4)
+	if _, err = rand.Read(p); err != nil {
+		return "", "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+	prefix = hex.EncodeToString(p)
+	key = APIKeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, prefix, HashAPIKey(key), nil
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *Auth) validateAPIKey(key string) (string, error) {
+	if a.APIKeys == nil {
+		return "", ErrInvalidToken
+	}
+	rest := strings.TrimPrefix(key, APIKeyPrefix)
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" {
+		return "", ErrInvalidToken
+	}
+	ctx := context.Background()
+	k, err := a.APIKeys.GetByPrefix(ctx, prefix)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(HashAPIKey(key))) != 1 || k.RevokedAt != 0 {
+		return "", ErrInvalidToken
+	}
+	a.APIKeys.Touch(ctx, k.ID, time.Now().Unix())
+	return k.UserID, nil
+}
@@ -1,20 +1,34 @@
 package auth
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"time"
 
+	"github.com/1cbyc/go-websocket-server/internal/model"
 	"github.com/golang-jwt/jwt/v5"
 )
 
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrDisabled     = errors.New("account disabled")
+)
+
 type Auth struct {
-	Secret     []byte
-	Expiry     time.Duration
+	Secret  []byte
+	Expiry  time.Duration
+	Users   model.UserStore
+	APIKeys model.APIKeyStore
+	Logins  *LoginThrottle
+	OIDC    *OIDC
 }
 
 func New(secret string, expiry time.Duration) *Auth {
 	return &Auth{
 		Secret: []byte(secret),
 		Expiry: expiry,
+		Logins: NewLoginThrottle(5, 15*time.Minute),
 	}
 }
 
@@ -27,20 +41,44 @@ func (a *Auth) GenerateToken(userID string) (string, error) {
 	return token.SignedString(a.Secret)
 }
 
+// ValidateToken accepts either a JWT minted by GenerateToken or an API key
+// and returns the user ID it belongs to.
 func (a *Auth) ValidateToken(tokenStr string) (string, error) {
+	var userID string
+	var err error
+	if strings.HasPrefix(tokenStr, APIKeyPrefix) {
+		userID, err = a.validateAPIKey(tokenStr)
+	} else {
+		userID, err = a.validateJWT(tokenStr)
+	}
+	if err != nil {
+		return "", err
+	}
+	if a.Users != nil {
+		if u, err := a.Users.Get(context.Background(), userID); err == nil && u.Disabled {
+			return "", ErrDisabled
+		}
+	}
+	return userID, nil
+}
+
+func (a *Auth) validateJWT(tokenStr string) (string, error) {
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		return a.Secret, nil
-	})
-	if err != nil || !token.Valid {
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
 		return "", err
 	}
+	if !token.Valid {
+		return "", ErrInvalidToken
+	}
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return "", err
+		return "", ErrInvalidToken
 	}
 	userID, ok := claims["sub"].(string)
-	if !ok {
-		return "", err
+	if !ok || userID == "" {
+		return "", ErrInvalidToken
 	}
 	return userID, nil
-} 
\ No newline at end of file
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const MinPasswordLength = 8
+
+var ErrWeakPassword = errors.New("password must be between 8 and 72 bytes")
+
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength || len(password) > 72 {
+		return "", ErrWeakPassword
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// dummyHash stands in for the hash of an account that has none, so that
+// checking a password takes as long whether or not the name exists and
+// logins cannot be used to find out which names are taken.
+const dummyHash = "$2a$10$8jdFS2vbMxeTJB3wQQDoleH9g73JTXXBRJQGYmBLzl.lmTt.roGju"
+
+// CheckPassword reports whether password matches hash. An empty hash, for
+// an unknown user or one without a password, never matches but costs the
+// same bcrypt comparison.
+func CheckPassword(hash, password string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// LoginThrottle locks a key out for a while after too many failed logins.
+type LoginThrottle struct {
+	max      int
+	lockout  time.Duration
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func NewLoginThrottle(max int, lockout time.Duration) *LoginThrottle {
+	return &LoginThrottle{
+		max:      max,
+		lockout:  lockout,
+		attempts: make(map[string]*loginAttempts),
+	}
+}
+
+// Allow reports whether key may attempt a login, and if not, how long
+// until it may try again.
+func (t *LoginThrottle) Allow(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	la, ok := t.attempts[key]
+	if !ok {
+		return true, 0
+	}
+	if wait := time.Until(la.lockedUntil); wait > 0 {
+		return false, wait
+	}
+	return true, 0
+}
+
+func (t *LoginThrottle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, la := range t.attempts {
+		if now.Sub(la.first) > t.lockout && now.After(la.lockedUntil) {
+			delete(t.attempts, k)
+		}
+	}
+	la, ok := t.attempts[key]
+	if !ok {
+		la = &loginAttempts{first: now}
+		t.attempts[key] = la
+	}
+	la.failures++
+	if t.max > 0 && la.failures >= t.max {
+		la.lockedUntil = now.Add(t.lockout)
+		la.failures = 0
+		la.first = now
+	}
+}
+
+func (t *LoginThrottle) Reset(key string) {
+	t.mu.Lock()
+	delete(t.attempts, key)
+	t.mu.Unlock()
+}
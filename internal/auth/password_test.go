@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	type step struct {
+		action string // "fail", "reset" or "allow"
+		key    string
+		want   bool
+	}
+	tests := []struct {
+		name  string
+		max   int
+		steps []step
+	}{
+		{"under the limit", 3, []step{
+			{"fail", "a", false}, {"fail", "a", false}, {"allow", "a", true},
+		}},
+		{"locked at the limit", 3, []step{
+			{"fail", "a", false}, {"fail", "a", false}, {"fail", "a", false}, {"allow", "a", false},
+		}},
+		{"keys apart", 2, []step{
+			{"fail", "a", false}, {"fail", "a", false}, {"allow", "a", false}, {"allow", "b", true},
+		}},
+		{"reset clears failures", 2, []step{
+			{"fail", "a", false}, {"reset", "a", false}, {"fail", "a", false}, {"allow", "a", true},
+		}},
+		{"reset lifts a lockout", 1, []step{
+			{"fail", "a", false}, {"reset", "a", false}, {"allow", "a", true},
+		}},
+		{"no limit", 0, []step{
+			{"fail", "a", false}, {"fail", "a", false}, {"fail", "a", false}, {"allow", "a", true},
+		}},
+	}
+	for _, tt := range tests {
+		th := NewLoginThrottle(tt.max, time.Minute)
+		for i, st := range tt.steps {
+			switch st.action {
+			case "fail":
+				th.Fail(st.key)
+			case "reset":
+				th.Reset(st.key)
+			case "allow":
+				ok, wait := th.Allow(st.key)
+				if ok != st.want {
+					t.Errorf("%s: step %d: got %v, want %v", tt.name, i, ok, st.want)
+				}
+				if !ok && (wait <= 0 || wait > time.Minute) {
+					t.Errorf("%s: step %d: got wait %v", tt.name, i, wait)
+				}
+			}
+		}
+	}
+}
+
+func TestLoginThrottleLockoutEnds(t *testing.T) {
+	th := NewLoginThrottle(1, 20*time.Millisecond)
+	th.Fail("a")
+	ok, wait := th.Allow("a")
+	if ok {
+		t.Fatal("not locked out")
+	}
+	time.Sleep(wait)
+	if ok, _ := th.Allow("a"); !ok {
+		t.Error("still locked out")
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"match", hash, "correct horse", true},
+		{"wrong password", hash, "battery staple", false},
+		{"no hash", "", "correct horse", false},
+		{"no hash, empty password", "", "", false},
+	}
+	for _, tt := range tests {
+		if got := CheckPassword(tt.hash, tt.password); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPasswordUnknownUserTiming(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	CheckPassword(hash, "battery staple")
+	known := time.Since(start)
+	start = time.Now()
+	CheckPassword("", "battery staple")
+	if unknown := time.Since(start); unknown < known/4 {
+		t.Errorf("unknown user took %v, known %v", unknown, known)
+	}
+}
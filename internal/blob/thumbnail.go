@@ -0,0 +1,78 @@
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// ThumbnailSize is the longest side of a thumbnail in pixels.
+const ThumbnailSize = 256
+
+// maxThumbnailPixels refuses to decode images big enough to exhaust
+// memory, at up to 64 MB decoded; they are stored but get no thumbnail.
+const maxThumbnailPixels = 16_000_000
+
+var ErrTooLarge = errors.New("image too large for a thumbnail")
+
+// Thumbnail decodes a PNG, JPEG or GIF image and scales it down to fit
+// ThumbnailSize. JPEG sources give a JPEG thumbnail, others a PNG so
+// transparency survives. It also returns the source dimensions.
+func Thumbnail(r io.Reader) (thumb []byte, mimeType string, width, height int, err error) {
+	var buf bytes.Buffer
+	cfg, format, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return nil, "", cfg.Width, cfg.Height, ErrTooLarge
+	}
+	src, _, err := image.Decode(io.MultiReader(&buf, r))
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	dst := scale(src, ThumbnailSize)
+	var out bytes.Buffer
+	mimeType = ThumbnailType("image/" + format)
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&out, dst)
+	}
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	return out.Bytes(), mimeType, cfg.Width, cfg.Height, nil
+}
+
+// ThumbnailType is the MIME type of the thumbnail made for an image of
+// type mimeType.
+func ThumbnailType(mimeType string) string {
+	if mimeType == "image/jpeg" {
+		return mimeType
+	}
+	return "image/png"
+}
+
+// scale shrinks src so its longer side is at most size. Smaller images
+// are returned as they are.
+func scale(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, max(h*size/w, 1)
+	if h > w {
+		dw, dh = max(w*size/h, 1), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
@@ -2,12 +2,55 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Addr     string
-	LogLevel string
-	DBDSN    string
+	Addr             string
+	LogLevel         string
+	DBDSN            string
+	AdminUsers       []string
+	LoginMaxAttempts int
+	LoginLockout     time.Duration
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	OIDCNameClaim    string
+	AllowedOrigins   []string
+	RateMessages     float64
+	RateMessageBurst int
+	RateConnects     float64
+	RateConnectBurst int
+	RateREST         float64
+	RateRESTBurst    int
+	MaxConns         int
+	MaxConnsPerUser  int
+	MaxConnsPerIP    int
+	AwayAfter        time.Duration
+	PresenceDebounce time.Duration
+	InstanceID       string
+	ReconcileEvery   time.Duration
+	InstanceTimeout  time.Duration
+	RateTyping       float64
+	RateTypingBurst  int
+	TypingTimeout    time.Duration
+	BlobDir          string
+	MaxUploadBytes   int
+	UploadTypes      []string
+	UploadTTL        time.Duration
+	SearchLike       bool
+	RetentionEvery   time.Duration
+	RetentionBatch   int
+	RetentionMaxAge  time.Duration
+	RetentionMaxKeep int
+	ExpireEvery      time.Duration
+	MaxMessageTTL    time.Duration
+	ScheduleEvery    time.Duration
+	RoomRestoreFor   time.Duration
 }
 
 func Load() *Config {
@@ -24,8 +67,134 @@ func Load() *Config {
 		dbDsn = "file:messages.db?_foreign_keys=on"
 	}
 	return &Config{
-		Addr:     addr,
-		LogLevel: logLevel,
-		DBDSN:    dbDsn,
+		Addr:             addr,
+		LogLevel:         logLevel,
+		DBDSN:            dbDsn,
+		AdminUsers:       envList("WS_ADMIN_USERS"),
+		LoginMaxAttempts: envInt("WS_LOGIN_MAX_ATTEMPTS", 5),
+		LoginLockout:     envDuration("WS_LOGIN_LOCKOUT", 15*time.Minute),
+		OIDCIssuer:       os.Getenv("WS_OIDC_ISSUER"),
+		OIDCClientID:     os.Getenv("WS_OIDC_CLIENT_ID"),
+		OIDCClientSecret: os.Getenv("WS_OIDC_CLIENT_SECRET"),
+		OIDCRedirectURL:  os.Getenv("WS_OIDC_REDIRECT_URL"),
+		OIDCScopes:       envList("WS_OIDC_SCOPES"),
+		OIDCNameClaim:    envString("WS_OIDC_NAME_CLAIM", "preferred_username"),
+		AllowedOrigins:   envList("WS_ALLOWED_ORIGINS"),
+		RateMessages:     envFloat("WS_RATE_MESSAGES", 5),
+		RateMessageBurst: envInt("WS_RATE_MESSAGE_BURST", 10),
+		RateConnects:     envFloat("WS_RATE_CONNECTS", 1),
+		RateConnectBurst: envInt("WS_RATE_CONNECT_BURST", 10),
+		RateREST:         envFloat("WS_RATE_REST", 10),
+		RateRESTBurst:    envInt("WS_RATE_REST_BURST", 20),
+		MaxConns:         envInt("WS_MAX_CONNS", 10000),
+		MaxConnsPerUser:  envInt("WS_MAX_CONNS_PER_USER", 10),
+		MaxConnsPerIP:    envInt("WS_MAX_CONNS_PER_IP", 50),
+		AwayAfter:        envDuration("WS_AWAY_AFTER", 5*time.Minute),
+		PresenceDebounce: envDuration("WS_PRESENCE_DEBOUNCE", 5*time.Second),
+		InstanceID:       envString("WS_INSTANCE_ID", hostname()),
+		ReconcileEvery:   envDuration("WS_PRESENCE_RECONCILE", time.Minute),
+		InstanceTimeout:  envDuration("WS_INSTANCE_TIMEOUT", 3*time.Minute),
+		RateTyping:       envFloat("WS_RATE_TYPING", 1),
+		RateTypingBurst:  envInt("WS_RATE_TYPING_BURST", 3),
+		TypingTimeout:    envDuration("WS_TYPING_TIMEOUT", 6*time.Second),
+		BlobDir:          envString("WS_BLOB_DIR", "blobs"),
+		MaxUploadBytes:   envInt("WS_MAX_UPLOAD_BYTES", 10<<20),
+		UploadTypes:      uploadTypes(),
+		UploadTTL:        envDuration("WS_UPLOAD_TTL", 24*time.Hour),
+		SearchLike:       envBool("WS_SEARCH_LIKE", false),
+		RetentionEvery:   envDuration("WS_RETENTION_INTERVAL", time.Hour),
+		RetentionBatch:   envInt("WS_RETENTION_BATCH", 500),
+		RetentionMaxAge:  envDuration("WS_RETENTION_MAX_AGE", 0),
+		RetentionMaxKeep: envInt("WS_RETENTION_MAX_COUNT", 0),
+		ExpireEvery:      envDuration("WS_EXPIRE_INTERVAL", time.Second),
+		MaxMessageTTL:    envDuration("WS_MAX_MESSAGE_TTL", 7*24*time.Hour),
+		ScheduleEvery:    envDuration("WS_SCHEDULE_INTERVAL", time.Second),
+		RoomRestoreFor:   envDuration("WS_ROOM_RESTORE_WINDOW", 30*24*time.Hour),
 	}
 }
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "default"
+	}
+	return h
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+func envList(key string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// uploadTypes lists the MIME types attachments may have; entries such as
+// image/* allow a whole family.
+func uploadTypes() []string {
+	if types := envList("WS_UPLOAD_TYPES"); len(types) > 0 {
+		return types
+	}
+	return []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"}
+}
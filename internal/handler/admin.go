@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/gorilla/mux"
+)
+
+func AdminConnectionsHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callerID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if !s.IsAdmin(callerID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.ConnCounts())
+	})
+}
+
+// AdminRetentionHandler manages retention policies: /admin/retention for
+// the global policy and the list of room policies, and
+// /admin/retention/{roomID} for one room's own policy.
+func AdminRetentionHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callerID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if !s.IsAdmin(callerID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		roomID := mux.Vars(r)["roomID"]
+		switch r.Method {
+		case http.MethodGet:
+			if roomID != "" {
+				p, err := s.RoomRetention(r.Context(), roomID)
+				if err != nil {
+					retentionError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(p)
+				return
+			}
+			global, err := s.GlobalRetention(r.Context())
+			if err != nil {
+				retentionError(w, err)
+				return
+			}
+			rooms, err := s.RoomRetentions(r.Context())
+			if err != nil {
+				retentionError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Global *model.RetentionPolicy
+				Rooms  []*model.RetentionPolicy
+			}{global, rooms})
+		case http.MethodPut:
+			var req struct {
+				MaxAge    int64 `json:"max_age"`
+				MaxCount  int   `json:"max_count"`
+				LegalHold bool  `json:"legal_hold"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			p := model.RetentionPolicy{RoomID: roomID, MaxAge: req.MaxAge, MaxCount: req.MaxCount, LegalHold: req.LegalHold}
+			if err := s.SetRetention(r.Context(), callerID, &p); err != nil {
+				retentionError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(p)
+		case http.MethodDelete:
+			if err := s.DeleteRetention(r.Context(), roomID); err != nil {
+				retentionError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func retentionError(w http.ResponseWriter, err error) {
+	switch err {
+	case server.ErrPolicyNotFound, server.ErrRoomNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case server.ErrInvalidPolicy:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "failed to update retention policy", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type apiKeyResponse struct {
+	Key    string        `json:"key"`
+	APIKey *model.APIKey `json:"api_key"`
+}
+
+func ServiceAccountsHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callerID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if !s.IsAdmin(callerID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Name        string `json:"name"`
+			DisplayName string `json:"display_name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validUserName.MatchString(req.Name) {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.Users().GetByName(r.Context(), req.Name); err == nil {
+			http.Error(w, "name already taken", http.StatusConflict)
+			return
+		}
+		if req.DisplayName == "" {
+			req.DisplayName = req.Name
+		}
+		user := &model.User{
+			ID:             uuid.NewString(),
+			Name:           req.Name,
+			DisplayName:    req.DisplayName,
+			ServiceAccount: true,
+			CreatedAt:      time.Now().Unix(),
+		}
+		if err := s.Users().Create(r.Context(), user); err != nil {
+			http.Error(w, "failed to create service account", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user)
+	})
+}
+
+func APIKeysHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callerID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if !s.IsAdmin(callerID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			userID := r.URL.Query().Get("user_id")
+			if userID == "" {
+				http.Error(w, "missing user_id", http.StatusBadRequest)
+				return
+			}
+			keys, err := s.APIKeys().ListByUser(r.Context(), userID)
+			if err != nil {
+				http.Error(w, "failed to list api keys", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(keys)
+		case http.MethodPost:
+			var req struct {
+				UserID string `json:"user_id"`
+				Name   string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			user, err := s.Users().Get(r.Context(), req.UserID)
+			if err != nil || !user.ServiceAccount {
+				http.Error(w, "service account not found", http.StatusNotFound)
+				return
+			}
+			resp, err := createAPIKey(s, r, user.ID, req.Name)
+			if err != nil {
+				http.Error(w, "failed to create api key", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(resp)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func APIKeyHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callerID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if !s.IsAdmin(callerID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		keyID := vars["keyID"]
+		if err := s.APIKeys().Revoke(r.Context(), keyID, time.Now().Unix()); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func APIKeyRotateHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callerID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if !s.IsAdmin(callerID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		keyID := vars["keyID"]
+		old, err := s.APIKeys().Get(r.Context(), keyID)
+		if err != nil || old.RevokedAt != 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		resp, err := createAPIKey(s, r, old.UserID, old.Name)
+		if err != nil {
+			http.Error(w, "failed to create api key", http.StatusInternalServerError)
+			return
+		}
+		if err := s.APIKeys().Revoke(r.Context(), old.ID, time.Now().Unix()); err != nil {
+			http.Error(w, "failed to revoke api key", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// apiKeyAttempts bounds how many fresh keys createAPIKey generates when
+// the random prefix collides with an existing key's.
+const apiKeyAttempts = 3
+
+func createAPIKey(s *server.Server, r *http.Request, userID, name string) (*apiKeyResponse, error) {
+	var err error
+	for i := 0; i < apiKeyAttempts; i++ {
+		var key, prefix, hash string
+		key, prefix, hash, err = auth.GenerateAPIKey()
+		if err != nil {
+			return nil, err
+		}
+		k := &model.APIKey{
+			ID:        uuid.NewString(),
+			UserID:    userID,
+			Name:      name,
+			Prefix:    prefix,
+			Hash:      hash,
+			CreatedAt: time.Now().Unix(),
+		}
+		err = s.APIKeys().Create(r.Context(), k)
+		if err == nil {
+			return &apiKeyResponse{Key: key, APIKey: k}, nil
+		}
+		if !errors.Is(err, model.ErrPrefixTaken) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
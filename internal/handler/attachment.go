@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/blob"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/gorilla/mux"
+)
+
+// RoomAttachmentsHandler accepts a multipart upload with the file in the
+// "file" field. The returned attachment ID is then sent along with a
+// message.
+func RoomAttachmentsHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		// Leave room for the multipart framing around the file.
+		r.Body = http.MaxBytesReader(w, r.Body, int64(s.Config().MaxUploadBytes)+64<<10)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, server.ErrUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "missing file", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() != "file" {
+				part.Close()
+				continue
+			}
+			att, err := s.Upload(r.Context(), userID, vars["roomID"], part.FileName(), part)
+			part.Close()
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				switch {
+				case err == server.ErrForbidden:
+					http.Error(w, "not found", http.StatusNotFound)
+				case err == server.ErrUploadTooLarge || errors.As(err, &tooLarge):
+					http.Error(w, server.ErrUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				case err == server.ErrUnsupportedType:
+					http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				case err == server.ErrRoomArchived:
+					http.Error(w, err.Error(), http.StatusConflict)
+				default:
+					http.Error(w, "failed to store file", http.StatusInternalServerError)
+				}
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(att)
+			return
+		}
+	})
+}
+
+// AttachmentHandler downloads an attachment, or its thumbnail when
+// thumbnail is set, to a member of its room.
+func AttachmentHandler(s *server.Server, a *auth.Auth, thumbnail bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		att, rc, err := s.OpenAttachment(r.Context(), userID, vars["attachmentID"], thumbnail)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		defer rc.Close()
+		contentType := att.MIMEType
+		if thumbnail {
+			contentType = blob.ThumbnailType(att.MIMEType)
+		} else {
+			w.Header().Set("Content-Length", strconv.FormatInt(att.Size, 10))
+		}
+		disposition := "attachment"
+		if strings.HasPrefix(contentType, "image/") {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": att.Name}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(24*time.Hour/time.Second)))
+		io.Copy(w, rc)
+	})
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var validUserName = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+type tokenResponse struct {
+	Token string      `json:"token"`
+	User  *model.User `json:"user"`
+}
+
+func RegisterHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Name        string `json:"name"`
+			Password    string `json:"password"`
+			DisplayName string `json:"display_name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validUserName.MatchString(req.Name) {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.Users().GetByName(r.Context(), req.Name); err == nil {
+			http.Error(w, "name already taken", http.StatusConflict)
+			return
+		}
+		hash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.DisplayName == "" {
+			req.DisplayName = req.Name
+		}
+		user := &model.User{
+			ID:           uuid.NewString(),
+			Name:         req.Name,
+			DisplayName:  req.DisplayName,
+			PasswordHash: hash,
+			CreatedAt:    time.Now().Unix(),
+		}
+		if err := s.Users().Create(r.Context(), user); err != nil {
+			http.Error(w, "failed to create user", http.StatusInternalServerError)
+			return
+		}
+		token, err := a.GenerateToken(user.ID)
+		if err != nil {
+			http.Error(w, "failed to issue token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(tokenResponse{Token: token, User: user})
+	})
+}
+
+func LoginHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		key := strings.ToLower(req.Name) + "|" + clientIP(r)
+		if ok, wait := a.Logins.Allow(key); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "too many login attempts", http.StatusTooManyRequests)
+			return
+		}
+		user, err := s.Users().GetByName(r.Context(), req.Name)
+		hash := ""
+		if err == nil {
+			hash = user.PasswordHash
+		}
+		if !auth.CheckPassword(hash, req.Password) {
+			a.Logins.Fail(key)
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		a.Logins.Reset(key)
+		if user.Disabled {
+			http.Error(w, "account disabled", http.StatusForbidden)
+			return
+		}
+		token, err := a.GenerateToken(user.ID)
+		if err != nil {
+			http.Error(w, "failed to issue token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{Token: token, User: user})
+	})
+}
+
+func UserHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authenticate(w, r, a); !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		userID := vars["userID"]
+		user, err := s.Users().Get(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	})
+}
+
+func UserDisabledHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callerID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if !s.IsAdmin(callerID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Disabled bool `json:"disabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		vars := mux.Vars(r)
+		userID := vars["userID"]
+		if err := s.Users().SetDisabled(r.Context(), userID, req.Disabled); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+)
+
+// ConversationsHandler lists the caller's direct conversations (GET) or
+// opens one with the given users (POST). Opening an existing conversation
+// returns it rather than creating another.
+func ConversationsHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			convs, err := s.Conversations(r.Context(), userID)
+			if err != nil {
+				http.Error(w, "failed to list conversations", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(convs)
+		case http.MethodPost:
+			var req struct {
+				UserIDs []string `json:"user_ids"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			room, err := s.OpenConversation(r.Context(), userID, req.UserIDs)
+			if err != nil {
+				if err == server.ErrInvalidConversation {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				http.Error(w, "failed to open conversation", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(room)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/1cbyc/go-websocket-server/internal/config"
+	"github.com/gorilla/mux"
+)
+
+// CORS answers preflight requests and adds CORS headers for origins listed
+// in WS_ALLOWED_ORIGINS. With no list configured only same-origin browser
+// requests are allowed.
+func CORS(cfg *config.Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			allowed := originAllowed(cfg.AllowedOrigins, origin, r.Host)
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+			}
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				if !allowed {
+					http.Error(w, "origin not allowed", http.StatusForbidden)
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// originAllowed reports whether origin may talk to us. Entries in allowed
+// are full origins such as https://chat.example.com, https://*.example.com
+// for any subdomain, or * for everything.
+func originAllowed(allowed []string, origin, host string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if len(allowed) == 0 {
+		return strings.EqualFold(u.Host, host)
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSuffix(a, "/"))
+		if a == "*" || a == origin {
+			return true
+		}
+		if scheme, pattern, ok := strings.Cut(a, "://*."); ok && scheme == strings.ToLower(u.Scheme) &&
+			strings.HasSuffix(strings.ToLower(u.Host), "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/1cbyc/go-websocket-server/internal/auth"
 	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/ratelimit"
 	"github.com/1cbyc/go-websocket-server/internal/server"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -15,39 +15,45 @@ import (
 )
 
 func WebSocketHandler(s *server.Server, a *auth.Auth) http.Handler {
+	ws := websocket.Server{
+		Handler: s.HandleWS,
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			cfg.Origin, _ = websocket.Origin(cfg, r)
+			return nil
+		},
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
+		if !originAllowed(s.Config().AllowedOrigins, r.Header.Get("Origin"), r.Host) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
 		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
+		if ok, wait := s.AllowConnect(clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(ratelimit.RetryAfter(wait)))
+			http.Error(w, "too many connection attempts", http.StatusTooManyRequests)
 			return
 		}
-		_, err := a.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		ip := clientIP(r)
+		if err := s.AcquireConn(userID, ip); err != nil {
+			status := http.StatusTooManyRequests
+			if err == server.ErrServerFull {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
-		websocket.Handler(s.HandleWS).ServeHTTP(w, r)
+		defer s.ReleaseConn(userID, ip)
+		r.Header.Set("X-User-ID", userID)
+		ws.ServeHTTP(w, r)
 	})
 }
 
 func HistoryHandler(s *server.Server, a *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
-		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
-		}
-		_, err := a.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		if _, ok := authenticate(w, r, a); !ok {
 			return
 		}
 		limit := 50
@@ -61,6 +67,10 @@ func HistoryHandler(s *server.Server, a *auth.Auth) http.Handler {
 			http.Error(w, "failed to fetch history", http.StatusInternalServerError)
 			return
 		}
+		s.FillMessages(r.Context(), msgs...)
+		if wantsHTML(r) {
+			s.RenderHTML(msgs...)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(msgs)
 	})
@@ -68,18 +78,7 @@ func HistoryHandler(s *server.Server, a *auth.Auth) http.Handler {
 
 func PresenceOnlineHandler(s *server.Server, a *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
-		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
-		}
-		_, err := a.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		if _, ok := authenticate(w, r, a); !ok {
 			return
 		}
 		ps, err := s.Presence().ListOnline(r.Context())
@@ -94,18 +93,8 @@ func PresenceOnlineHandler(s *server.Server, a *auth.Auth) http.Handler {
 
 func PresenceUserHandler(s *server.Server, a *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
-		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
-		}
-		_, err := a.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		callerID, ok := authenticate(w, r, a)
+		if !ok {
 			return
 		}
 		vars := mux.Vars(r)
@@ -115,25 +104,58 @@ func PresenceUserHandler(s *server.Server, a *auth.Auth) http.Handler {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		if p.Status == model.StatusInvisible && callerID != userID {
+			p = &model.Presence{UserID: p.UserID, Status: model.StatusOffline, LastSeen: p.LastSeen}
+		} else {
+			p.Devices = s.Devices(userID)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(p)
 	})
 }
 
-func RoomsHandler(s *server.Server, a *auth.Auth) http.Handler {
+func PresenceStatusHandler(s *server.Server, a *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
 		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		userID, err := a.ValidateToken(token)
+		var req struct {
+			Status    model.PresenceStatus `json:"status"`
+			Text      string               `json:"text"`
+			Emoji     string               `json:"emoji"`
+			ExpiresIn int64                `json:"expires_in"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.SetStatus(r.Context(), userID, req.Status, req.Text, req.Emoji, req.ExpiresIn); err != nil {
+			if err == server.ErrInvalidStatus {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "failed to set status", http.StatusInternalServerError)
+			return
+		}
+		p, err := s.Presence().Get(r.Context(), userID)
 		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+			http.Error(w, "failed to fetch status", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	})
+}
+
+func RoomsHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
 			return
 		}
 		switch r.Method {
@@ -154,7 +176,7 @@ func RoomsHandler(s *server.Server, a *auth.Auth) http.Handler {
 				http.Error(w, "invalid request", http.StatusBadRequest)
 				return
 			}
-			room := &model.Room{ID: uuid.NewString(), Name: req.Name, Members: req.Members}
+			room := &model.Room{ID: uuid.NewString(), Name: req.Name, Members: req.Members, OwnerID: userID}
 			if len(room.Members) == 0 {
 				room.Members = []string{userID}
 			}
@@ -172,50 +194,73 @@ func RoomsHandler(s *server.Server, a *auth.Auth) http.Handler {
 
 func RoomHandler(s *server.Server, a *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
-		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
-		}
-		_, err := a.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		userID, ok := authenticate(w, r, a)
+		if !ok {
 			return
 		}
 		vars := mux.Vars(r)
 		roomID := vars["roomID"]
-		room, err := s.RoomStore().Get(r.Context(), roomID)
-		if err != nil {
-			http.Error(w, "not found", http.StatusNotFound)
-			return
+		switch r.Method {
+		case http.MethodGet:
+			room, err := s.RoomStore().Get(r.Context(), roomID)
+			if err != nil || !canSee(room, userID) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(room)
+		case http.MethodPatch:
+			var req struct {
+				Name        *string            `json:"name"`
+				Archived    *bool              `json:"archived"`
+				Topic       *string            `json:"topic"`
+				Description *string            `json:"description"`
+				AvatarURL   *string            `json:"avatar_url"`
+				Attributes  map[string]*string `json:"attributes"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			room, err := s.UpdateRoom(r.Context(), userID, roomID, &server.RoomUpdate{
+				Name:        req.Name,
+				Archived:    req.Archived,
+				Topic:       req.Topic,
+				Description: req.Description,
+				AvatarURL:   req.AvatarURL,
+				Attributes:  req.Attributes,
+			})
+			if err != nil {
+				roomError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(room)
+		case http.MethodDelete:
+			hard := r.URL.Query().Get("hard") == "true"
+			if err := s.DeleteRoom(r.Context(), userID, roomID, hard); err != nil {
+				roomError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(room)
 	})
 }
 
 func RoomJoinHandler(s *server.Server, a *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
-		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
-		}
-		userID, err := a.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		userID, ok := authenticate(w, r, a)
+		if !ok {
 			return
 		}
 		vars := mux.Vars(r)
 		roomID := vars["roomID"]
+		if room, err := s.RoomStore().Get(r.Context(), roomID); err == nil && (room.Direct || room.DeletedAt != 0) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
 		if err := s.RoomStore().AddMember(r.Context(), roomID, userID); err != nil {
 			http.Error(w, "failed to join room", http.StatusInternalServerError)
 			return
@@ -226,22 +271,20 @@ func RoomJoinHandler(s *server.Server, a *auth.Auth) http.Handler {
 
 func RoomLeaveHandler(s *server.Server, a *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
-		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
-		}
-		userID, err := a.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		userID, ok := authenticate(w, r, a)
+		if !ok {
 			return
 		}
 		vars := mux.Vars(r)
 		roomID := vars["roomID"]
+		if room, err := s.RoomStore().Get(r.Context(), roomID); err == nil && room.Direct {
+			if !room.HasMember(userID) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "cannot leave a direct conversation", http.StatusBadRequest)
+			return
+		}
 		if err := s.RoomStore().RemoveMember(r.Context(), roomID, userID); err != nil {
 			http.Error(w, "failed to leave room", http.StatusInternalServerError)
 			return
@@ -252,22 +295,16 @@ func RoomLeaveHandler(s *server.Server, a *auth.Auth) http.Handler {
 
 func RoomHistoryHandler(s *server.Server, a *auth.Auth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := ""
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
-		}
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
-		}
-		_, err := a.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		userID, ok := authenticate(w, r, a)
+		if !ok {
 			return
 		}
 		vars := mux.Vars(r)
 		roomID := vars["roomID"]
+		if room, err := s.RoomStore().Get(r.Context(), roomID); err == nil && !canSee(room, userID) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
 		limit := 50
 		if l := r.URL.Query().Get("limit"); l != "" {
 			if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 200 {
@@ -279,6 +316,10 @@ func RoomHistoryHandler(s *server.Server, a *auth.Auth) http.Handler {
 			http.Error(w, "failed to fetch history", http.StatusInternalServerError)
 			return
 		}
+		s.FillMessages(r.Context(), msgs...)
+		if wantsHTML(r) {
+			s.RenderHTML(msgs...)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(msgs)
 	})
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/gorilla/mux"
+)
+
+func MessageHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		messageID := vars["messageID"]
+		switch r.Method {
+		case http.MethodGet:
+			msg, err := s.Store().Get(r.Context(), messageID)
+			if err != nil {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			if !s.CanAccess(r.Context(), userID, msg.RoomID) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			s.FillMessages(r.Context(), msg)
+			if wantsHTML(r) {
+				s.RenderHTML(msg)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(msg)
+		case http.MethodPatch:
+			var req struct {
+				Content string `json:"content"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Content == "" {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			msg, err := s.EditMessage(r.Context(), userID, messageID, req.Content)
+			if err != nil {
+				messageError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(msg)
+		case http.MethodDelete:
+			if _, err := s.DeleteMessage(r.Context(), userID, messageID); err != nil {
+				messageError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// MessageRevisionsHandler lists a message's earlier contents. Only the
+// author and those who may moderate the room can see them.
+func MessageRevisionsHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		msg, err := s.Store().Get(r.Context(), vars["messageID"])
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if msg.UserID != userID && !s.CanModerate(r.Context(), userID, msg.RoomID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		revs, err := s.Store().ListRevisions(r.Context(), msg.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch revisions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(revs)
+	})
+}
+
+// RoomThreadHandler returns a thread's root message and its latest
+// replies.
+func RoomThreadHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		roomID := vars["roomID"]
+		if !s.CanAccess(r.Context(), userID, roomID) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		limit := 50
+		if l := r.URL.Query().Get("limit"); l != "" {
+			if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 200 {
+				limit = n
+			}
+		}
+		thread, err := s.Thread(r.Context(), roomID, vars["messageID"], limit)
+		if err != nil {
+			if err == server.ErrMessageNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to fetch thread", http.StatusInternalServerError)
+			return
+		}
+		if wantsHTML(r) {
+			s.RenderHTML(thread.Root)
+			s.RenderHTML(thread.Replies...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(thread)
+	})
+}
+
+func messageError(w http.ResponseWriter, err error) {
+	switch err {
+	case server.ErrMessageNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case server.ErrForbidden:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case server.ErrMessageDeleted, server.ErrRoomArchived:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case server.ErrEmptyContent, server.ErrContentTooLong, server.ErrNotEditable:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "failed to update message", http.StatusInternalServerError)
+	}
+}
+
+// wantsHTML reports whether the client asked for markdown messages to be
+// rendered with ?render=html.
+func wantsHTML(r *http.Request) bool {
+	return r.URL.Query().Get("render") == "html"
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// oidcStateCookie ties a login to the browser that started it, so a
+// callback carrying someone else's state is refused.
+const oidcStateCookie = "oidc_state"
+
+func OIDCLoginHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.OIDC == nil {
+			http.Error(w, "oidc not configured", http.StatusNotFound)
+			return
+		}
+		u, state, err := a.OIDC.Begin()
+		if err != nil {
+			http.Error(w, "failed to start login", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/auth/oidc",
+			MaxAge:   int(a.OIDC.TTL / time.Second),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, u, http.StatusFound)
+	})
+}
+
+func OIDCCallbackHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.OIDC == nil {
+			http.Error(w, "oidc not configured", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+			return
+		}
+		browserState := ""
+		if c, err := r.Cookie(oidcStateCookie); err == nil {
+			browserState = c.Value
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc", MaxAge: -1, HttpOnly: true})
+		id, err := a.OIDC.Complete(r.Context(), q.Get("state"), browserState, q.Get("code"))
+		if err != nil {
+			s.Logger().Warn("oidc login failed", zap.Error(err))
+			http.Error(w, "login failed", http.StatusUnauthorized)
+			return
+		}
+		user, err := s.Users().GetByIdentity(r.Context(), id.Issuer, id.Subject)
+		if err != nil {
+			user, err = createOIDCUser(r.Context(), s, id)
+			if err != nil {
+				http.Error(w, "failed to create user", http.StatusInternalServerError)
+				return
+			}
+		}
+		if user.Disabled {
+			http.Error(w, "account disabled", http.StatusForbidden)
+			return
+		}
+		token, err := a.GenerateToken(user.ID)
+		if err != nil {
+			http.Error(w, "failed to issue token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{Token: token, User: user})
+	})
+}
+
+// createOIDCUser provisions a local account the first time an IdP
+// identity signs in. The local name comes from the configured claim and
+// is made unique if another account already uses it. The account and its
+// link to the identity are stored together, so a failed link leaves no
+// account behind.
+func createOIDCUser(ctx context.Context, s *server.Server, id *auth.Identity) (*model.User, error) {
+	name := id.Claim(s.Config().OIDCNameClaim)
+	if name == "" {
+		name, _, _ = strings.Cut(id.Claim("email"), "@")
+	}
+	name = invalidNameChars.ReplaceAllString(name, "")
+	if len(name) > 24 {
+		name = name[:24]
+	}
+	if len(name) < 3 {
+		name = "user"
+	}
+	if _, err := s.Users().GetByName(ctx, name); err == nil {
+		name = name + "-" + uuid.NewString()[:6]
+	}
+	displayName := id.Claim("name")
+	if displayName == "" {
+		displayName = name
+	}
+	user := &model.User{
+		ID:          uuid.NewString(),
+		Name:        name,
+		DisplayName: displayName,
+		CreatedAt:   time.Now().Unix(),
+	}
+	if err := s.Users().CreateWithIdentity(ctx, user, id.Issuer, id.Subject); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/ratelimit"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/gorilla/mux"
+)
+
+// RateLimit limits REST calls per user, falling back to the client
+// address for requests without a valid token, such as login. Keying on
+// the validated user rather than the raw header keeps clients from getting
+// a fresh bucket by sending made-up tokens. The outcome of validating the
+// token is kept in the request context for authenticate.
+func RateLimit(s *server.Server, a *auth.Auth) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := validateRequest(r, a)
+			key := "ip:" + clientIP(r)
+			if id.err == nil {
+				key = "user:" + id.userID
+			}
+			if ok, wait := s.AllowREST(key); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(ratelimit.RetryAfter(wait)))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+		})
+	}
+}
+
+type identityKey struct{}
+
+// identity is the result of validating a request's bearer token.
+type identity struct {
+	userID string
+	err    error
+}
+
+var errMissingToken = errors.New("missing token")
+
+func validateRequest(r *http.Request, a *auth.Auth) identity {
+	h := r.Header.Get("Authorization")
+	token := ""
+	if strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return identity{err: errMissingToken}
+	}
+	userID, err := a.ValidateToken(token)
+	return identity{userID: userID, err: err}
+}
+
+// authenticate returns the user the request's bearer token belongs to,
+// reusing RateLimit's validation when it ran, and otherwise writes a 401
+// and returns false.
+func authenticate(w http.ResponseWriter, r *http.Request, a *auth.Auth) (string, bool) {
+	id, ok := r.Context().Value(identityKey{}).(identity)
+	if !ok {
+		id = validateRequest(r, a)
+	}
+	switch {
+	case errors.Is(id.err, errMissingToken):
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return "", false
+	case id.err != nil:
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return "", false
+	}
+	return id.userID, true
+}
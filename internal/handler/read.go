@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/gorilla/mux"
+)
+
+func RoomReadHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		roomID := vars["roomID"]
+		if !s.CanAccess(r.Context(), userID, roomID) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			markers, err := s.ReadMarkers().ListByRoom(r.Context(), roomID)
+			if err != nil {
+				http.Error(w, "failed to fetch read markers", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(markers)
+		case http.MethodPost:
+			var req struct {
+				MessageID string `json:"message_id"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == "" {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			m, err := s.MarkRead(r.Context(), userID, roomID, req.MessageID)
+			if err != nil {
+				if err == server.ErrMessageNotFound {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				http.Error(w, "failed to mark read", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(m)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func UnreadHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		counts, err := s.UnreadCounts(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "failed to count unread messages", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(counts)
+	})
+}
+
+// canSee reports whether userID may look at room: direct conversations
+// are hidden from everyone but their members, and deleted rooms from
+// everyone.
+func canSee(room *model.Room, userID string) bool {
+	return room.DeletedAt == 0 && (!room.Direct || room.HasMember(userID))
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/gorilla/mux"
+)
+
+// RoomPinsHandler lists a room's pinned messages.
+func RoomPinsHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		pins, err := s.Pins(r.Context(), userID, mux.Vars(r)["roomID"])
+		if err != nil {
+			roomError(w, err)
+			return
+		}
+		if wantsHTML(r) {
+			for _, p := range pins {
+				s.RenderHTML(p.Message)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pins)
+	})
+}
+
+// RoomPinHandler pins (PUT) or unpins (DELETE) a message in a room.
+func RoomPinHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		switch r.Method {
+		case http.MethodPut:
+			pin, err := s.PinMessage(r.Context(), userID, vars["roomID"], vars["messageID"])
+			if err != nil {
+				roomError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(pin)
+		case http.MethodDelete:
+			if err := s.UnpinMessage(r.Context(), userID, vars["roomID"], vars["messageID"]); err != nil {
+				roomError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// RoomRestoreHandler brings back a deleted room (POST) while it can still
+// be restored.
+func RoomRestoreHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		room, err := s.RestoreRoom(r.Context(), userID, mux.Vars(r)["roomID"])
+		if err != nil {
+			roomError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	})
+}
+
+func roomError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, server.ErrRoomNotFound), errors.Is(err, server.ErrMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, server.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, server.ErrMessageDeleted), errors.Is(err, server.ErrTooManyPins),
+		errors.Is(err, server.ErrRoomArchived), errors.Is(err, server.ErrRoomNotDeleted),
+		errors.Is(err, server.ErrLegalHold):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, server.ErrInvalidRoomMeta):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "failed to update room", http.StatusInternalServerError)
+	}
+}
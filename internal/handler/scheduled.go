@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+	"github.com/gorilla/mux"
+)
+
+// ScheduledMessagesHandler lists the caller's pending scheduled messages
+// (GET) or schedules a new one (POST).
+func ScheduledMessagesHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			list, err := s.ScheduledMessages(r.Context(), userID)
+			if err != nil {
+				http.Error(w, "failed to list scheduled messages", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		case http.MethodPost:
+			var req struct {
+				RoomID        string            `json:"room_id"`
+				Content       string            `json:"content"`
+				Type          model.ContentType `json:"type"`
+				Body          json.RawMessage   `json:"body"`
+				ParentID      string            `json:"parent_id"`
+				TTL           int64             `json:"ttl"`
+				ExpireMode    model.ExpireMode  `json:"expire_mode"`
+				AttachmentIDs []string          `json:"attachment_ids"`
+				SendAt        int64             `json:"send_at"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			sm, err := s.ScheduleMessage(r.Context(), userID, &model.ScheduledMessage{
+				RoomID:        req.RoomID,
+				Content:       req.Content,
+				Type:          req.Type,
+				Body:          req.Body,
+				ParentID:      req.ParentID,
+				TTL:           req.TTL,
+				ExpireMode:    req.ExpireMode,
+				AttachmentIDs: req.AttachmentIDs,
+				SendAt:        req.SendAt,
+			})
+			if err != nil {
+				scheduledError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(sm)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ScheduledMessageHandler shows (GET), edits (PATCH) or cancels (DELETE)
+// one of the caller's pending scheduled messages. PATCH changes only the
+// fields it is given.
+func ScheduledMessageHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["scheduledID"]
+		switch r.Method {
+		case http.MethodGet:
+			sm, err := s.ScheduledMessage(r.Context(), userID, id)
+			if err != nil {
+				scheduledError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sm)
+		case http.MethodPatch:
+			var req struct {
+				Content    *string            `json:"content"`
+				Type       *model.ContentType `json:"type"`
+				Body       json.RawMessage    `json:"body"`
+				TTL        *int64             `json:"ttl"`
+				ExpireMode *model.ExpireMode  `json:"expire_mode"`
+				SendAt     *int64             `json:"send_at"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			sm, err := s.ScheduledMessage(r.Context(), userID, id)
+			if err != nil {
+				scheduledError(w, err)
+				return
+			}
+			if req.Content != nil {
+				sm.Content = *req.Content
+			}
+			if req.Type != nil {
+				sm.Type = *req.Type
+				sm.Body = nil
+			}
+			if req.Body != nil {
+				sm.Body = req.Body
+			}
+			if req.TTL != nil {
+				sm.TTL = *req.TTL
+				sm.ExpireMode = ""
+			}
+			if req.ExpireMode != nil {
+				sm.ExpireMode = *req.ExpireMode
+			}
+			if req.SendAt != nil {
+				sm.SendAt = *req.SendAt
+			}
+			sm, err = s.UpdateScheduled(r.Context(), userID, sm)
+			if err != nil {
+				scheduledError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sm)
+		case http.MethodDelete:
+			if err := s.CancelScheduled(r.Context(), userID, id); err != nil {
+				scheduledError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func scheduledError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, server.ErrScheduleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, server.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, server.ErrTooManyScheduled), errors.Is(err, server.ErrRoomArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, server.ErrRoomRequired), errors.Is(err, server.ErrInvalidSendAt),
+		errors.Is(err, server.ErrInvalidContent), errors.Is(err, server.ErrContentTooLong),
+		errors.Is(err, server.ErrEmptyContent), errors.Is(err, server.ErrInvalidTTL),
+		errors.Is(err, server.ErrInvalidParent), errors.Is(err, server.ErrInvalidAttachments):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "failed to update scheduled message", http.StatusInternalServerError)
+	}
+}
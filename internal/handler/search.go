@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/1cbyc/go-websocket-server/internal/auth"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/server"
+)
+
+// SearchHandler searches the messages of the caller's rooms. Besides q it
+// takes room_id, user_id, after and before (unix seconds), limit and the
+// cursor returned with the previous page.
+func SearchHandler(s *server.Server, a *auth.Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticate(w, r, a)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		q := &model.SearchQuery{
+			Text:     query.Get("q"),
+			AuthorID: query.Get("user_id"),
+			Limit:    20,
+		}
+		if strings.TrimSpace(q.Text) == "" {
+			http.Error(w, "missing query", http.StatusBadRequest)
+			return
+		}
+		if l := query.Get("limit"); l != "" {
+			if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 100 {
+				q.Limit = n
+			}
+		}
+		for name, dst := range map[string]*int64{"after": &q.After, "before": &q.Before, "cursor": &q.BeforeSeq} {
+			if v := query.Get(name); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || n < 0 {
+					http.Error(w, "invalid "+name, http.StatusBadRequest)
+					return
+				}
+				*dst = n
+			}
+		}
+		page, err := s.Search(r.Context(), userID, query.Get("room_id"), q)
+		if err != nil {
+			http.Error(w, "search failed", http.StatusInternalServerError)
+			return
+		}
+		if wantsHTML(r) {
+			for _, res := range page.Results {
+				s.RenderHTML(res.Message)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	})
+}
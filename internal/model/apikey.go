@@ -0,0 +1,111 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrPrefixTaken is returned by Create when another key already has the
+// new key's prefix. The caller should generate a fresh key and try again.
+var ErrPrefixTaken = errors.New("api key prefix taken")
+
+type APIKey struct {
+	ID         string
+	UserID     string
+	Name       string
+	Prefix     string
+	Hash       string `json:"-"`
+	CreatedAt  int64
+	LastUsedAt int64
+	RevokedAt  int64
+}
+
+type APIKeyStore interface {
+	Create(ctx context.Context, k *APIKey) error
+	Get(ctx context.Context, id string) (*APIKey, error)
+	GetByPrefix(ctx context.Context, prefix string) (*APIKey, error)
+	ListByUser(ctx context.Context, userID string) ([]*APIKey, error)
+	Revoke(ctx context.Context, id string, at int64) error
+	Touch(ctx context.Context, id string, at int64) error
+}
+
+type SQLiteAPIKeyStore struct {
+	db *sql.DB
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, hash, created_at, last_used_at, revoked_at`
+
+func NewSQLiteAPIKeyStore(dsn string) (*SQLiteAPIKeyStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_keys (id TEXT PRIMARY KEY, user_id TEXT, name TEXT, prefix TEXT UNIQUE, hash TEXT, created_at INTEGER, last_used_at INTEGER, revoked_at INTEGER)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteAPIKeyStore{db: db}, nil
+}
+
+func (s *SQLiteAPIKeyStore) Create(ctx context.Context, k *APIKey) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO api_keys (`+apiKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, k.ID, k.UserID, k.Name, k.Prefix, k.Hash, k.CreatedAt, k.LastUsedAt, k.RevokedAt)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrPrefixTaken
+	}
+	return err
+}
+
+func (s *SQLiteAPIKeyStore) Get(ctx context.Context, id string) (*APIKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+}
+
+func (s *SQLiteAPIKeyStore) GetByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE prefix = ?`, prefix))
+}
+
+func (s *SQLiteAPIKeyStore) ListByUser(ctx context.Context, userID string) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []*APIKey
+	for rows.Next() {
+		var k APIKey
+		err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Hash, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+	return keys, nil
+}
+
+func (s *SQLiteAPIKeyStore) Revoke(ctx context.Context, id string, at int64) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at = 0`, at, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLiteAPIKeyStore) Touch(ctx context.Context, id string, at int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = ? WHERE id = ?`, at, id)
+	return err
+}
+
+func scanAPIKey(row *sql.Row) (*APIKey, error) {
+	var k APIKey
+	err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Hash, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
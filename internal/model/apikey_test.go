@@ -0,0 +1,33 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateAPIKeyPrefixTaken(t *testing.T) {
+	s, err := NewSQLiteAPIKeyStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		key     *APIKey
+		wantErr error
+	}{
+		{"first", &APIKey{ID: "a", Prefix: "abcd"}, nil},
+		{"same prefix", &APIKey{ID: "b", Prefix: "abcd"}, ErrPrefixTaken},
+		{"other prefix", &APIKey{ID: "c", Prefix: "ef01"}, nil},
+	}
+	for _, tt := range tests {
+		if err := s.Create(ctx, tt.key); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if err := s.Create(ctx, &APIKey{ID: "a", Prefix: "9999"}); err == nil || errors.Is(err, ErrPrefixTaken) {
+		t.Errorf("duplicate id: got %v, want a plain error", err)
+	}
+}
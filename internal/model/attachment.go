@@ -0,0 +1,209 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Attachment is an uploaded file. It belongs to the room it was uploaded
+// to and, once sent, to a single message.
+type Attachment struct {
+	ID           string
+	UserID       string
+	RoomID       string
+	MessageID    string `json:",omitempty"`
+	Name         string
+	MIMEType     string
+	Size         int64
+	Width        int  `json:",omitempty"`
+	Height       int  `json:",omitempty"`
+	HasThumbnail bool `json:",omitempty"`
+	CreatedAt    int64
+}
+
+type AttachmentStore interface {
+	Create(ctx context.Context, a *Attachment) error
+	Get(ctx context.Context, id string) (*Attachment, error)
+	// Attach links ids to messageID. Each must have been uploaded by
+	// userID to roomID and not be attached yet; otherwise nothing is
+	// linked and sql.ErrNoRows is returned.
+	Attach(ctx context.Context, ids []string, messageID, userID, roomID string) error
+	ListByMessages(ctx context.Context, messageIDs []string) (map[string][]*Attachment, error)
+	// DeleteByMessages removes the attachments of messageIDs and returns
+	// them so their files can be deleted too.
+	DeleteByMessages(ctx context.Context, messageIDs []string) ([]*Attachment, error)
+	// DeleteByRoom does the same for everything uploaded to roomID.
+	DeleteByRoom(ctx context.Context, roomID string) ([]*Attachment, error)
+	// Detach unlinks the attachments of a message that failed to save so
+	// they can be sent again.
+	Detach(ctx context.Context, messageID string) error
+	// DeleteUnattached removes up to limit files uploaded before the given
+	// time that were never sent and are not waiting in a scheduled
+	// message, and returns them.
+	DeleteUnattached(ctx context.Context, before int64, limit int) ([]*Attachment, error)
+}
+
+type SQLiteAttachmentStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteAttachmentStore(dsn string) (*SQLiteAttachmentStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS attachments (id TEXT PRIMARY KEY, user_id TEXT, room_id TEXT, message_id TEXT NOT NULL DEFAULT '', name TEXT, mime_type TEXT, size INTEGER, width INTEGER, height INTEGER, has_thumbnail INTEGER, created_at INTEGER)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS attachments_message ON attachments (message_id)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteAttachmentStore{db: db}, nil
+}
+
+func (s *SQLiteAttachmentStore) Create(ctx context.Context, a *Attachment) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO attachments (id, user_id, room_id, message_id, name, mime_type, size, width, height, has_thumbnail, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.UserID, a.RoomID, a.MessageID, a.Name, a.MIMEType, a.Size, a.Width, a.Height, boolToInt(a.HasThumbnail), a.CreatedAt)
+	return err
+}
+
+const attachmentColumns = `id, user_id, room_id, message_id, name, mime_type, size, width, height, has_thumbnail, created_at`
+
+func (s *SQLiteAttachmentStore) Get(ctx context.Context, id string) (*Attachment, error) {
+	return scanAttachment(s.db.QueryRowContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, id))
+}
+
+func (s *SQLiteAttachmentStore) Attach(ctx context.Context, ids []string, messageID, userID, roomID string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	args := []interface{}{messageID, userID, roomID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE attachments SET message_id = ? WHERE user_id = ? AND room_id = ? AND message_id = '' AND id IN (`+placeholders(len(ids))+`)`, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != int64(len(ids)) {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteAttachmentStore) ListByMessages(ctx context.Context, messageIDs []string) (map[string][]*Attachment, error) {
+	byMessage := make(map[string][]*Attachment)
+	if len(messageIDs) == 0 {
+		return byMessage, nil
+	}
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE message_id IN (`+placeholders(len(messageIDs))+`) ORDER BY created_at, rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		byMessage[a.MessageID] = append(byMessage[a.MessageID], a)
+	}
+	return byMessage, rows.Err()
+}
+
+func (s *SQLiteAttachmentStore) DeleteByMessages(ctx context.Context, messageIDs []string) ([]*Attachment, error) {
+	byMessage, err := s.ListByMessages(ctx, messageIDs)
+	if err != nil || len(byMessage) == 0 {
+		return nil, err
+	}
+	var removed []*Attachment
+	var args []interface{}
+	for _, list := range byMessage {
+		for _, a := range list {
+			removed = append(removed, a)
+			args = append(args, a.ID)
+		}
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM attachments WHERE id IN (`+placeholders(len(args))+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (s *SQLiteAttachmentStore) DeleteByRoom(ctx context.Context, roomID string) ([]*Attachment, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE room_id = ?`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var removed []*Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM attachments WHERE room_id = ?`, roomID); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (s *SQLiteAttachmentStore) Detach(ctx context.Context, messageID string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE attachments SET message_id = '' WHERE message_id = ?`, messageID)
+	return err
+}
+
+func (s *SQLiteAttachmentStore) DeleteUnattached(ctx context.Context, before int64, limit int) ([]*Attachment, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE message_id = '' AND created_at < ?
+		AND NOT EXISTS (SELECT 1 FROM scheduled_messages WHERE ',' || attachment_ids || ',' LIKE '%,' || attachments.id || ',%')
+		ORDER BY created_at LIMIT ?`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var removed []*Attachment
+	var args []interface{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, a)
+		args = append(args, a.ID)
+	}
+	if err := rows.Err(); err != nil || len(removed) == 0 {
+		return nil, err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM attachments WHERE message_id = '' AND id IN (`+placeholders(len(args))+`)`, args...); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	var a Attachment
+	var thumb int
+	err := row.Scan(&a.ID, &a.UserID, &a.RoomID, &a.MessageID, &a.Name, &a.MIMEType, &a.Size, &a.Width, &a.Height, &thumb, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	a.HasThumbnail = thumb == 1
+	return &a, nil
+}
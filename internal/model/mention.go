@@ -0,0 +1,94 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+type MentionKind string
+
+const (
+	MentionUser MentionKind = "user"
+	MentionRoom MentionKind = "room"
+	MentionHere MentionKind = "here"
+)
+
+// Mention records that a message called out a user, by name or through
+// @room or @here.
+type Mention struct {
+	MessageID string
+	RoomID    string
+	UserID    string
+	AuthorID  string
+	Kind      MentionKind
+	Timestamp int64
+	// Message is filled in when mentions are listed or delivered.
+	Message *Message `json:",omitempty"`
+}
+
+type MentionStore interface {
+	// Add records m unless the user was already mentioned in the message,
+	// and reports whether it was new.
+	Add(ctx context.Context, m *Mention) (bool, error)
+	ListByUser(ctx context.Context, userID string, limit int) ([]*Mention, error)
+	DeleteByMessages(ctx context.Context, messageIDs []string) error
+}
+
+type SQLiteMentionStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteMentionStore(dsn string) (*SQLiteMentionStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS mentions (message_id TEXT, room_id TEXT, user_id TEXT, author_id TEXT, kind TEXT, timestamp INTEGER, PRIMARY KEY (message_id, user_id))`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS mentions_user ON mentions (user_id, timestamp)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteMentionStore{db: db}, nil
+}
+
+func (s *SQLiteMentionStore) Add(ctx context.Context, m *Mention) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO mentions (message_id, room_id, user_id, author_id, kind, timestamp) VALUES (?, ?, ?, ?, ?, ?)`, m.MessageID, m.RoomID, m.UserID, m.AuthorID, m.Kind, m.Timestamp)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteMentionStore) ListByUser(ctx context.Context, userID string, limit int) ([]*Mention, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT message_id, room_id, user_id, author_id, kind, timestamp FROM mentions WHERE user_id = ? ORDER BY timestamp DESC, rowid DESC LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ms []*Mention
+	for rows.Next() {
+		var m Mention
+		err := rows.Scan(&m.MessageID, &m.RoomID, &m.UserID, &m.AuthorID, &m.Kind, &m.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, &m)
+	}
+	return ms, nil
+}
+
+func (s *SQLiteMentionStore) DeleteByMessages(ctx context.Context, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM mentions WHERE message_id IN (`+placeholders(len(messageIDs))+`)`, args...)
+	return err
+}
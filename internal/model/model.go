@@ -3,46 +3,271 @@ package model
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"sort"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type User struct {
-	ID   string
-	Name string
+	ID             string
+	Name           string
+	DisplayName    string
+	PasswordHash   string `json:"-"`
+	Disabled       bool
+	ServiceAccount bool
+	CreatedAt      int64
 }
 
+// Message is a chat message. Seq is its position in the store, increasing
+// with every saved message, and is what read markers point at.
 type Message struct {
-	ID        string
-	UserID    string
-	RoomID    string
-	Content   string
+	ID      string
+	Seq     int64
+	UserID  string
+	RoomID  string
+	Content string
+	// Type says how to read the message; empty means plain text. Code
+	// and card messages carry their structure in Body and a plain-text
+	// rendering in Content for clients that do not understand it.
+	Type      ContentType     `json:",omitempty"`
+	Body      json.RawMessage `json:",omitempty"`
 	Timestamp int64
+	EditedAt  int64 `json:",omitempty"`
+	// TTL, in seconds, makes the message ephemeral: it is deleted
+	// ExpiresAt, which is TTL after it was sent or, in ExpireOnRead mode,
+	// after someone other than its author first read it.
+	TTL        int64      `json:",omitempty"`
+	ExpireMode ExpireMode `json:",omitempty"`
+	ExpiresAt  int64      `json:",omitempty"`
+	Deleted    bool       `json:",omitempty"`
+	// ParentID names the thread root this message replies to. Roots
+	// carry the number of replies and when the latest one arrived.
+	ParentID    string `json:",omitempty"`
+	ReplyCount  int    `json:",omitempty"`
+	LastReplyAt int64  `json:",omitempty"`
+	// Reactions and Attachments are filled in by history reads, not
+	// stored with the message.
+	Reactions   []ReactionCount `json:",omitempty"`
+	Attachments []*Attachment   `json:",omitempty"`
+	// HTML is the sanitized rendering of a markdown message, filled in
+	// for clients that ask for it.
+	HTML string `json:",omitempty"`
+}
+
+type ExpireMode string
+
+const (
+	ExpireOnSend ExpireMode = "send"
+	ExpireOnRead ExpireMode = "read"
+)
+
+type ContentType string
+
+const (
+	ContentText     ContentType = "text"
+	ContentMarkdown ContentType = "markdown"
+	ContentCode     ContentType = "code"
+	ContentCard     ContentType = "card"
+	ContentSystem   ContentType = "system"
+)
+
+// CodeBody is the Body of a code snippet.
+type CodeBody struct {
+	Language string `json:",omitempty"`
+	Code     string
+}
+
+// CardBody is the Body of a card: a titled block with optional link,
+// image and fields, plus arbitrary JSON for clients that know what to do
+// with it.
+type CardBody struct {
+	Title    string          `json:",omitempty"`
+	Text     string          `json:",omitempty"`
+	URL      string          `json:",omitempty"`
+	ImageURL string          `json:",omitempty"`
+	Fields   []CardField     `json:",omitempty"`
+	Data     json.RawMessage `json:",omitempty"`
+}
+
+type CardField struct {
+	Name  string
+	Value string
+}
+
+// SystemBody is the Body of a notice the server posts when a room
+// changes. Event names what happened, like the matching live event, and
+// the other fields say what it happened to.
+type SystemBody struct {
+	Event     string
+	Name      string `json:",omitempty"`
+	MessageID string `json:",omitempty"`
+}
+
+// Thread is a root message together with a page of its replies.
+type Thread struct {
+	Root    *Message
+	Replies []*Message
+}
+
+// MessageRevision is a message's content as it was before an edit or
+// deletion replaced it.
+type MessageRevision struct {
+	MessageID string
+	Content   string
+	EditorID  string
+	EditedAt  int64
 }
 
 type Room struct {
 	ID      string
 	Name    string
 	Members []string
+	OwnerID string
+	// Direct marks a one-to-one or small group conversation. Its members
+	// are fixed and only they can see it.
+	Direct      bool              `json:",omitempty"`
+	Topic       string            `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	AvatarURL   string            `json:",omitempty"`
+	Attributes  map[string]string `json:",omitempty"`
+	// An archived room is read-only. A deleted one is hidden from everyone
+	// until it is restored or, once the restore window passes, purged: it
+	// is emptied for good and kept only as a tombstone so its ID is never
+	// taken over by an ad hoc room.
+	Archived  bool  `json:",omitempty"`
+	DeletedAt int64 `json:",omitempty"`
+	Purged    bool  `json:",omitempty"`
 }
 
+// HasMember reports whether userID belongs to r. A deleted room has no
+// members until it is restored.
+func (r *Room) HasMember(userID string) bool {
+	if r.DeletedAt != 0 {
+		return false
+	}
+	for _, m := range r.Members {
+		if m == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Conversation is a direct conversation as listed for one participant.
+type Conversation struct {
+	Room        *Room
+	LastMessage *Message `json:",omitempty"`
+	Unread      int
+}
+
+// ConversationKey identifies the direct conversation between userIDs
+// regardless of their order.
+func ConversationKey(userIDs []string) string {
+	ids := append([]string(nil), userIDs...)
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+type PresenceStatus string
+
+const (
+	StatusOnline    PresenceStatus = "online"
+	StatusAway      PresenceStatus = "away"
+	StatusBusy      PresenceStatus = "busy"
+	StatusInvisible PresenceStatus = "invisible"
+	StatusOffline   PresenceStatus = "offline"
+)
+
+// Presence combines whether a user is connected with the status they
+// chose. Status is kept while they are offline so it survives reconnects;
+// AutoAway marks an away status set by the server after inactivity.
 type Presence struct {
-	UserID   string
-	Online   bool
-	LastSeen int64
+	UserID          string
+	Online          bool
+	LastSeen        int64
+	Status          PresenceStatus
+	StatusText      string   `json:",omitempty"`
+	StatusEmoji     string   `json:",omitempty"`
+	StatusExpiresAt int64    `json:",omitempty"`
+	AutoAway        bool     `json:",omitempty"`
+	Devices         []Device `json:",omitempty"`
+}
+
+// Device is one live connection of a user, e.g. their phone or laptop.
+type Device struct {
+	SessionID   string
+	Name        string
+	ConnectedAt int64
+}
+
+// Event is a server-generated WebSocket frame. Chat messages are still
+// sent as bare Message objects; everything else is named by Event.
+type Event struct {
+	Event     string
+	RoomID    string      `json:",omitempty"`
+	UserID    string      `json:",omitempty"`
+	Data      interface{} `json:",omitempty"`
+	Timestamp int64
+}
+
+type TypingData struct {
+	Typing bool
+}
+
+type ErrorData struct {
+	Code       string
+	Message    string
+	RetryAfter int `json:",omitempty"`
 }
 
 type MessageStore interface {
 	Save(ctx context.Context, msg *Message) error
 	List(ctx context.Context, limit int) ([]*Message, error)
 	ListByRoom(ctx context.Context, roomID string, limit int) ([]*Message, error)
+	Get(ctx context.Context, id string) (*Message, error)
+	CountAfter(ctx context.Context, roomID string, seq int64, excludeUserID string) (int, error)
+	Update(ctx context.Context, id, content, editorID string, at int64) error
+	Delete(ctx context.Context, id, editorID string, at int64) error
+	ListRevisions(ctx context.Context, id string) ([]*MessageRevision, error)
+	ListReplies(ctx context.Context, parentID string, limit int) ([]*Message, error)
+	// RoomIDs lists every room that has messages.
+	RoomIDs(ctx context.Context) ([]string, error)
+	// Expired returns up to limit IDs of roomID's messages, oldest first,
+	// that were sent before the given time or fall outside its newest keep
+	// messages. A zero before or keep disables that limit.
+	Expired(ctx context.Context, roomID string, before int64, keep, limit int) ([]string, error)
+	// Remove permanently deletes messages and their revisions.
+	Remove(ctx context.Context, ids []string) error
+	// DeleteByRoom permanently deletes up to limit of roomID's messages
+	// and their revisions, and returns their IDs.
+	DeleteByRoom(ctx context.Context, roomID string, limit int) ([]string, error)
+	// StartExpiry starts the clock on roomID's read-once messages up to
+	// seq that readerID did not write.
+	StartExpiry(ctx context.Context, roomID, readerID string, seq, now int64) error
+	// Retire soft-deletes ephemeral messages that ran out in a room under
+	// legal hold, keeping their content as a revision, and stops them
+	// from being listed as expired again.
+	Retire(ctx context.Context, ids []string, at int64) error
+	// ListExpired returns up to limit ephemeral messages whose time ran
+	// out before now.
+	ListExpired(ctx context.Context, now int64, limit int) ([]*Message, error)
 }
 
 type PresenceStore interface {
 	Set(ctx context.Context, p *Presence) error
+	SetOnline(ctx context.Context, userID, instanceID string, online bool, lastSeen int64) error
+	SetStatus(ctx context.Context, p *Presence) error
 	Get(ctx context.Context, userID string) (*Presence, error)
 	ListOnline(ctx context.Context) ([]*Presence, error)
+	ExpireStatuses(ctx context.Context, now int64) ([]string, error)
+	ListOnlineByInstance(ctx context.Context, instanceID string) ([]string, error)
+	MarkInstanceOffline(ctx context.Context, instanceID string, lastSeen int64) ([]string, error)
+	Heartbeat(ctx context.Context, instanceID string, at int64) error
+	GetHeartbeat(ctx context.Context, instanceID string) (int64, error)
+	StaleInstances(ctx context.Context, before int64) (map[string]int64, error)
+	RemoveInstance(ctx context.Context, instanceID string) error
 }
 
 type RoomStore interface {
@@ -51,6 +276,21 @@ type RoomStore interface {
 	List(ctx context.Context) ([]*Room, error)
 	AddMember(ctx context.Context, roomID, userID string) error
 	RemoveMember(ctx context.Context, roomID, userID string) error
+	ListByMember(ctx context.Context, userID string) ([]*Room, error)
+	// GetConversation finds the direct conversation whose members are
+	// exactly userIDs.
+	GetConversation(ctx context.Context, userIDs []string) (*Room, error)
+	// Update saves room's name, metadata and archived flag.
+	Update(ctx context.Context, room *Room) error
+	// SetDeleted marks a room deleted at the given time, or restores it
+	// when at is 0.
+	SetDeleted(ctx context.Context, id string, at int64) error
+	// ListDeleted returns rooms deleted before the given time that have
+	// not been purged yet.
+	ListDeleted(ctx context.Context, before int64) ([]*Room, error)
+	// Purge clears a deleted room's name, members and metadata, leaving
+	// a tombstone.
+	Purge(ctx context.Context, id string) error
 }
 
 type SQLiteMessageStore struct {
@@ -70,54 +310,399 @@ func NewSQLiteMessageStore(dsn string) (*SQLiteMessageStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS messages (id TEXT PRIMARY KEY, user_id TEXT, room_id TEXT, content TEXT, timestamp INTEGER)`)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS messages (` + messageTable + `)`)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range messageExtraColumns {
+		if err := addColumn(db, "messages", c.name, c.decl); err != nil {
+			return nil, err
+		}
+	}
+	if err := addSeq(db); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS messages_parent ON messages (parent_id) WHERE parent_id != ''`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS messages_room ON messages (room_id)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS messages_expires ON messages (expires_at) WHERE expires_at != 0`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS message_revisions (message_id TEXT, content TEXT, editor_id TEXT, edited_at INTEGER)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS message_revisions_message ON message_revisions (message_id)`)
 	if err != nil {
 		return nil, err
 	}
 	return &SQLiteMessageStore{db: db}, nil
 }
 
+// messageTable is the messages table as first created; the columns that
+// came later are added by addColumn.
+const messageTable = `seq INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL UNIQUE, user_id TEXT, room_id TEXT, content TEXT, timestamp INTEGER`
+
+var messageExtraColumns = []struct{ name, decl string }{
+	{"edited_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"deleted", "INTEGER NOT NULL DEFAULT 0"},
+	{"type", "TEXT NOT NULL DEFAULT ''"},
+	{"body", "TEXT NOT NULL DEFAULT ''"},
+	{"ttl", "INTEGER NOT NULL DEFAULT 0"},
+	{"expire_mode", "TEXT NOT NULL DEFAULT ''"},
+	{"expires_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"parent_id", "TEXT NOT NULL DEFAULT ''"},
+	{"reply_count", "INTEGER NOT NULL DEFAULT 0"},
+	{"last_reply_at", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// addSeq rebuilds a messages table from before seq, whose order lived
+// only in the implicit rowid, with each message's rowid as its seq.
+// VACUUM may renumber a plain rowid, but not an INTEGER PRIMARY KEY, and
+// read markers, unread counts and the search index all rely on it.
+func addSeq(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name = 'seq'`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	cols := "id, user_id, room_id, content, timestamp"
+	for _, c := range messageExtraColumns {
+		cols += ", " + c.name
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmts := []string{`CREATE TABLE messages_new (` + messageTable + `)`}
+	for _, c := range messageExtraColumns {
+		stmts = append(stmts, `ALTER TABLE messages_new ADD COLUMN `+c.name+` `+c.decl)
+	}
+	stmts = append(stmts,
+		`INSERT INTO messages_new (seq, `+cols+`) SELECT rowid, `+cols+` FROM messages`,
+		`DROP TABLE messages`,
+		`ALTER TABLE messages_new RENAME TO messages`,
+	)
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const messageColumns = `seq, id, user_id, room_id, content, type, body, timestamp, edited_at, ttl, expire_mode, expires_at, deleted, parent_id, reply_count, last_reply_at`
+
+// unexpired keeps ephemeral messages that have run out of time but not
+// been removed yet out of reads.
+const unexpired = `(expires_at = 0 OR expires_at > unixepoch())`
+
+// Save stores msg and, for a reply, bumps its root's reply count and
+// last reply time in the same transaction.
 func (s *SQLiteMessageStore) Save(ctx context.Context, msg *Message) error {
-	_, err := s.db.ExecContext(ctx, `INSERT INTO messages (id, user_id, room_id, content, timestamp) VALUES (?, ?, ?, ?, ?)`, msg.ID, msg.UserID, msg.RoomID, msg.Content, msg.Timestamp)
-	return err
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `INSERT INTO messages (id, user_id, room_id, content, type, body, timestamp, ttl, expire_mode, expires_at, parent_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.ID, msg.UserID, msg.RoomID, msg.Content, msg.Type, string(msg.Body), msg.Timestamp, msg.TTL, msg.ExpireMode, msg.ExpiresAt, msg.ParentID)
+	if err != nil {
+		return err
+	}
+	if msg.ParentID != "" {
+		_, err = tx.ExecContext(ctx, `UPDATE messages SET reply_count = reply_count + 1, last_reply_at = MAX(last_reply_at, ?) WHERE id = ?`, msg.Timestamp, msg.ParentID)
+		if err != nil {
+			return err
+		}
+	}
+	msg.Seq, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// List returns the latest messages across all named rooms. Messages in
+// direct conversations are private to their members and left out.
 func (s *SQLiteMessageStore) List(ctx context.Context, limit int) ([]*Message, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, room_id, content, timestamp FROM messages ORDER BY timestamp DESC LIMIT ?`, limit)
+	return s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE room_id NOT IN (SELECT id FROM rooms WHERE dm_key != '') AND `+unexpired+` ORDER BY timestamp DESC LIMIT ?`, limit)
+}
+
+func (s *SQLiteMessageStore) ListByRoom(ctx context.Context, roomID string, limit int) ([]*Message, error) {
+	return s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE room_id = ? AND `+unexpired+` ORDER BY timestamp DESC LIMIT ?`, roomID, limit)
+}
+
+func (s *SQLiteMessageStore) ListReplies(ctx context.Context, parentID string, limit int) ([]*Message, error) {
+	return s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE parent_id = ? AND `+unexpired+` ORDER BY timestamp DESC LIMIT ?`, parentID, limit)
+}
+
+func (s *SQLiteMessageStore) Get(ctx context.Context, id string) (*Message, error) {
+	return scanMessage(s.db.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = ? AND `+unexpired, id))
+}
+
+// CountAfter counts messages in roomID newer than seq, ignoring those sent
+// by excludeUserID and deleted ones.
+func (s *SQLiteMessageStore) CountAfter(ctx context.Context, roomID string, seq int64, excludeUserID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE room_id = ? AND seq > ? AND user_id != ? AND deleted = 0 AND `+unexpired, roomID, seq, excludeUserID).Scan(&n)
+	return n, err
+}
+
+// Update replaces a message's content, keeping the old content as a
+// revision.
+func (s *SQLiteMessageStore) Update(ctx context.Context, id, content, editorID string, at int64) error {
+	return s.revise(ctx, id, editorID, at, `UPDATE messages SET content = ?, edited_at = ? WHERE id = ? AND deleted = 0`, content, at, id)
+}
+
+// Delete turns a message into a tombstone: it stays in history, without
+// content, flagged as deleted. The removed content is kept as a revision.
+func (s *SQLiteMessageStore) Delete(ctx context.Context, id, editorID string, at int64) error {
+	return s.revise(ctx, id, editorID, at, `UPDATE messages SET content = '', body = '', deleted = 1 WHERE id = ? AND deleted = 0`, id)
+}
+
+func (s *SQLiteMessageStore) revise(ctx context.Context, id, editorID string, at int64, update string, args ...interface{}) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `INSERT INTO message_revisions (message_id, content, editor_id, edited_at) SELECT id, content, ?, ? FROM messages WHERE id = ? AND deleted = 0`, editorID, at, id)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, update, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteMessageStore) ListRevisions(ctx context.Context, id string) ([]*MessageRevision, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT message_id, content, editor_id, edited_at FROM message_revisions WHERE message_id = ? ORDER BY edited_at, rowid`, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var msgs []*Message
+	var revs []*MessageRevision
 	for rows.Next() {
-		var m Message
-		err := rows.Scan(&m.ID, &m.UserID, &m.RoomID, &m.Content, &m.Timestamp)
+		var r MessageRevision
+		err := rows.Scan(&r.MessageID, &r.Content, &r.EditorID, &r.EditedAt)
 		if err != nil {
 			return nil, err
 		}
-		msgs = append(msgs, &m)
+		revs = append(revs, &r)
 	}
-	return msgs, nil
+	return revs, nil
 }
 
-func (s *SQLiteMessageStore) ListByRoom(ctx context.Context, roomID string, limit int) ([]*Message, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, room_id, content, timestamp FROM messages WHERE room_id = ? ORDER BY timestamp DESC LIMIT ?`, roomID, limit)
+func (s *SQLiteMessageStore) RoomIDs(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT room_id FROM messages`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLiteMessageStore) Expired(ctx context.Context, roomID string, before int64, keep, limit int) ([]string, error) {
+	var cutoff int64
+	if keep > 0 {
+		err := s.db.QueryRowContext(ctx, `SELECT seq FROM messages WHERE room_id = ? ORDER BY seq DESC LIMIT 1 OFFSET ?`, roomID, keep).Scan(&cutoff)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	if before <= 0 && cutoff == 0 {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM messages WHERE room_id = ? AND (timestamp < ? OR seq <= ?) ORDER BY seq LIMIT ?`, roomID, before, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Remove also recounts the replies of any thread that lost some, so the
+// roots left behind stay accurate.
+func (s *SQLiteMessageStore) Remove(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	in := placeholders(len(ids))
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT parent_id FROM messages WHERE parent_id != '' AND id IN (`+in+`)`, args...)
+	if err != nil {
+		return err
+	}
+	var parents []interface{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		parents = append(parents, id)
+	}
+	rows.Close()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id IN (`+in+`)`, args...); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_revisions WHERE message_id IN (`+in+`)`, args...); err != nil {
+		return err
+	}
+	if len(parents) > 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE messages SET
+			reply_count = (SELECT COUNT(*) FROM messages r WHERE r.parent_id = messages.id),
+			last_reply_at = (SELECT COALESCE(MAX(timestamp), 0) FROM messages r WHERE r.parent_id = messages.id)
+			WHERE id IN (`+placeholders(len(parents))+`)`, parents...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteByRoom leaves reply counts alone, since the whole room goes.
+func (s *SQLiteMessageStore) DeleteByRoom(ctx context.Context, roomID string, limit int) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM messages WHERE room_id = ? ORDER BY seq LIMIT ?`, roomID, limit)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	var args []interface{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		args = append(args, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	in := placeholders(len(ids))
+	if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id IN (`+in+`)`, args...); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_revisions WHERE message_id IN (`+in+`)`, args...); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+func (s *SQLiteMessageStore) StartExpiry(ctx context.Context, roomID, readerID string, seq, now int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE messages SET expires_at = ? + ttl WHERE room_id = ? AND expire_mode = ? AND expires_at = 0 AND user_id != ? AND seq <= ?`,
+		now, roomID, ExpireOnRead, readerID, seq)
+	return err
+}
+
+func (s *SQLiteMessageStore) Retire(ctx context.Context, ids []string, at int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	in := placeholders(len(ids))
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `INSERT INTO message_revisions (message_id, content, editor_id, edited_at) SELECT id, content, '', ? FROM messages WHERE deleted = 0 AND id IN (`+in+`)`, append([]interface{}{at}, args...)...)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE messages SET content = '', body = '', deleted = 1, expires_at = 0 WHERE id IN (`+in+`)`, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteMessageStore) ListExpired(ctx context.Context, now int64, limit int) ([]*Message, error) {
+	return s.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE expires_at != 0 AND expires_at <= ? ORDER BY expires_at LIMIT ?`, now, limit)
+}
+
+func (s *SQLiteMessageStore) queryMessages(ctx context.Context, query string, args ...interface{}) ([]*Message, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var msgs []*Message
 	for rows.Next() {
-		var m Message
-		err := rows.Scan(&m.ID, &m.UserID, &m.RoomID, &m.Content, &m.Timestamp)
+		m, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		msgs = append(msgs, &m)
+		msgs = append(msgs, m)
 	}
 	return msgs, nil
 }
 
+func scanMessage(row rowScanner) (*Message, error) {
+	var m Message
+	var deleted int
+	var body string
+	err := row.Scan(&m.Seq, &m.ID, &m.UserID, &m.RoomID, &m.Content, &m.Type, &body, &m.Timestamp, &m.EditedAt,
+		&m.TTL, &m.ExpireMode, &m.ExpiresAt, &deleted, &m.ParentID, &m.ReplyCount, &m.LastReplyAt)
+	if err != nil {
+		return nil, err
+	}
+	m.Deleted = deleted == 1
+	if body != "" {
+		m.Body = json.RawMessage(body)
+	}
+	return &m, nil
+}
+
 func NewSQLitePresenceStore(dsn string) (*SQLitePresenceStore, error) {
 	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
@@ -127,46 +712,176 @@ func NewSQLitePresenceStore(dsn string) (*SQLitePresenceStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, c := range [][2]string{
+		{"status", "TEXT NOT NULL DEFAULT 'online'"},
+		{"status_text", "TEXT NOT NULL DEFAULT ''"},
+		{"status_emoji", "TEXT NOT NULL DEFAULT ''"},
+		{"status_expires_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"auto_away", "INTEGER NOT NULL DEFAULT 0"},
+		{"instance_id", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := addColumn(db, "presence", c[0], c[1]); err != nil {
+			return nil, err
+		}
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS instances (id TEXT PRIMARY KEY, heartbeat INTEGER)`)
+	if err != nil {
+		return nil, err
+	}
 	return &SQLitePresenceStore{db: db}, nil
 }
 
+const presenceColumns = `user_id, online, last_seen, status, status_text, status_emoji, status_expires_at, auto_away`
+
 func (s *SQLitePresenceStore) Set(ctx context.Context, p *Presence) error {
-	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO presence (user_id, online, last_seen) VALUES (?, ?, ?)`, p.UserID, boolToInt(p.Online), p.LastSeen)
+	if p.Status == "" {
+		p.Status = StatusOnline
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO presence (`+presenceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, p.UserID, boolToInt(p.Online), p.LastSeen, p.Status, p.StatusText, p.StatusEmoji, p.StatusExpiresAt, boolToInt(p.AutoAway))
+	return err
+}
+
+func (s *SQLitePresenceStore) SetOnline(ctx context.Context, userID, instanceID string, online bool, lastSeen int64) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO presence (user_id, online, last_seen, instance_id) VALUES (?, ?, ?, ?) ON CONFLICT(user_id) DO UPDATE SET online = excluded.online, last_seen = excluded.last_seen, instance_id = excluded.instance_id`, userID, boolToInt(online), lastSeen, instanceID)
+	return err
+}
+
+func (s *SQLitePresenceStore) SetStatus(ctx context.Context, p *Presence) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO presence (user_id, online, last_seen, status, status_text, status_emoji, status_expires_at, auto_away) VALUES (?, 0, 0, ?, ?, ?, ?, ?) ON CONFLICT(user_id) DO UPDATE SET status = excluded.status, status_text = excluded.status_text, status_emoji = excluded.status_emoji, status_expires_at = excluded.status_expires_at, auto_away = excluded.auto_away`, p.UserID, p.Status, p.StatusText, p.StatusEmoji, p.StatusExpiresAt, boolToInt(p.AutoAway))
 	return err
 }
 
 func (s *SQLitePresenceStore) Get(ctx context.Context, userID string) (*Presence, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT user_id, online, last_seen FROM presence WHERE user_id = ?`, userID)
-	var p Presence
-	var online int
-	err := row.Scan(&p.UserID, &online, &p.LastSeen)
-	if err != nil {
-		return nil, err
-	}
-	p.Online = online == 1
-	return &p, nil
+	row := s.db.QueryRowContext(ctx, `SELECT `+presenceColumns+` FROM presence WHERE user_id = ?`, userID)
+	return scanPresence(row)
 }
 
 func (s *SQLitePresenceStore) ListOnline(ctx context.Context) ([]*Presence, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT user_id, online, last_seen FROM presence WHERE online = 1`)
+	rows, err := s.db.QueryContext(ctx, `SELECT `+presenceColumns+` FROM presence WHERE online = 1 AND status != ?`, StatusInvisible)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var ps []*Presence
 	for rows.Next() {
-		var p Presence
-		var online int
-		err := rows.Scan(&p.UserID, &online, &p.LastSeen)
+		p, err := scanPresence(rows)
 		if err != nil {
 			return nil, err
 		}
-		p.Online = online == 1
-		ps = append(ps, &p)
+		ps = append(ps, p)
 	}
 	return ps, nil
 }
 
+// ExpireStatuses resets custom statuses whose expiry has passed back to
+// online and returns the affected users.
+func (s *SQLitePresenceStore) ExpireStatuses(ctx context.Context, now int64) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id FROM presence WHERE status_expires_at > 0 AND status_expires_at <= ?`, now)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		_, err := s.db.ExecContext(ctx, `UPDATE presence SET status = ?, status_text = '', status_emoji = '', status_expires_at = 0, auto_away = 0 WHERE user_id = ? AND status_expires_at > 0 AND status_expires_at <= ?`, StatusOnline, id, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func (s *SQLitePresenceStore) ListOnlineByInstance(ctx context.Context, instanceID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id FROM presence WHERE online = 1 AND instance_id = ?`, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// MarkInstanceOffline marks every user still online through instanceID as
+// offline, last seen no earlier than lastSeen, and returns them.
+func (s *SQLitePresenceStore) MarkInstanceOffline(ctx context.Context, instanceID string, lastSeen int64) ([]string, error) {
+	ids, err := s.ListOnlineByInstance(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE presence SET online = 0, last_seen = MAX(last_seen, ?) WHERE online = 1 AND instance_id = ?`, lastSeen, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *SQLitePresenceStore) Heartbeat(ctx context.Context, instanceID string, at int64) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO instances (id, heartbeat) VALUES (?, ?)`, instanceID, at)
+	return err
+}
+
+func (s *SQLitePresenceStore) GetHeartbeat(ctx context.Context, instanceID string) (int64, error) {
+	var at int64
+	err := s.db.QueryRowContext(ctx, `SELECT heartbeat FROM instances WHERE id = ?`, instanceID).Scan(&at)
+	return at, err
+}
+
+// StaleInstances returns instances whose last heartbeat is older than
+// before, with that heartbeat.
+func (s *SQLitePresenceStore) StaleInstances(ctx context.Context, before int64) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, heartbeat FROM instances WHERE heartbeat < ?`, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stale := make(map[string]int64)
+	for rows.Next() {
+		var id string
+		var at int64
+		if err := rows.Scan(&id, &at); err != nil {
+			return nil, err
+		}
+		stale[id] = at
+	}
+	return stale, nil
+}
+
+func (s *SQLitePresenceStore) RemoveInstance(ctx context.Context, instanceID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM instances WHERE id = ?`, instanceID)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPresence(row rowScanner) (*Presence, error) {
+	var p Presence
+	var online, autoAway int
+	err := row.Scan(&p.UserID, &online, &p.LastSeen, &p.Status, &p.StatusText, &p.StatusEmoji, &p.StatusExpiresAt, &autoAway)
+	if err != nil {
+		return nil, err
+	}
+	p.Online = online == 1
+	p.AutoAway = autoAway == 1
+	return &p, nil
+}
+
 func NewSQLiteRoomStore(dsn string) (*SQLiteRoomStore, error) {
 	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
@@ -176,53 +891,147 @@ func NewSQLiteRoomStore(dsn string) (*SQLiteRoomStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := addColumn(db, "rooms", "owner_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "rooms", "dm_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS rooms_dm_key ON rooms (dm_key) WHERE dm_key != ''`)
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range []string{"topic", "description", "avatar_url", "attributes"} {
+		if err := addColumn(db, "rooms", col, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return nil, err
+		}
+	}
+	if err := addColumn(db, "rooms", "archived", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "rooms", "deleted_at", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "rooms", "purged", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
 	return &SQLiteRoomStore{db: db}, nil
 }
 
+// Create stores room. Creating a second direct conversation between the
+// same members fails on the unique dm_key.
 func (s *SQLiteRoomStore) Create(ctx context.Context, room *Room) error {
 	members := strings.Join(room.Members, ",")
-	_, err := s.db.ExecContext(ctx, `INSERT INTO rooms (id, name, members) VALUES (?, ?, ?)`, room.ID, room.Name, members)
+	key := ""
+	if room.Direct {
+		key = ConversationKey(room.Members)
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO rooms (id, name, members, owner_id, dm_key) VALUES (?, ?, ?, ?, ?)`, room.ID, room.Name, members, room.OwnerID, key)
 	return err
 }
 
+const roomColumns = `id, name, members, owner_id, dm_key != '', topic, description, avatar_url, attributes, archived, deleted_at, purged`
+
 func (s *SQLiteRoomStore) Get(ctx context.Context, id string) (*Room, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT id, name, members FROM rooms WHERE id = ?`, id)
-	var r Room
-	var members string
-	err := row.Scan(&r.ID, &r.Name, &members)
-	if err != nil {
-		return nil, err
-	}
-	r.Members = []string{}
-	if members != "" {
-		r.Members = strings.Split(members, ",")
-	}
-	return &r, nil
+	row := s.db.QueryRowContext(ctx, `SELECT `+roomColumns+` FROM rooms WHERE id = ?`, id)
+	return scanRoom(row)
 }
 
+// List returns the named rooms; direct conversations are left out.
 func (s *SQLiteRoomStore) List(ctx context.Context) ([]*Room, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id, name, members FROM rooms`)
+	return s.queryRooms(ctx, `SELECT `+roomColumns+` FROM rooms WHERE dm_key = '' AND deleted_at = 0`)
+}
+
+func (s *SQLiteRoomStore) GetConversation(ctx context.Context, userIDs []string) (*Room, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+roomColumns+` FROM rooms WHERE dm_key = ?`, ConversationKey(userIDs))
+	return scanRoom(row)
+}
+
+func (s *SQLiteRoomStore) ListByMember(ctx context.Context, userID string) ([]*Room, error) {
+	return s.queryRooms(ctx, `SELECT `+roomColumns+` FROM rooms WHERE instr(',' || members || ',', ',' || ? || ',') > 0 AND deleted_at = 0`, userID)
+}
+
+func (s *SQLiteRoomStore) queryRooms(ctx context.Context, query string, args ...interface{}) ([]*Room, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var rooms []*Room
 	for rows.Next() {
-		var r Room
-		var members string
-		err := rows.Scan(&r.ID, &r.Name, &members)
+		r, err := scanRoom(rows)
 		if err != nil {
 			return nil, err
 		}
-		r.Members = []string{}
-		if members != "" {
-			r.Members = strings.Split(members, ",")
-		}
-		rooms = append(rooms, &r)
+		rooms = append(rooms, r)
 	}
 	return rooms, nil
 }
 
+func scanRoom(row rowScanner) (*Room, error) {
+	var r Room
+	var members, attrs string
+	var archived, purged int
+	err := row.Scan(&r.ID, &r.Name, &members, &r.OwnerID, &r.Direct, &r.Topic, &r.Description, &r.AvatarURL, &attrs, &archived, &r.DeletedAt, &purged)
+	if err != nil {
+		return nil, err
+	}
+	r.Archived = archived == 1
+	r.Purged = purged == 1
+	r.Members = []string{}
+	if members != "" {
+		r.Members = strings.Split(members, ",")
+	}
+	if attrs != "" {
+		if err := json.Unmarshal([]byte(attrs), &r.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	return &r, nil
+}
+
+func (s *SQLiteRoomStore) Update(ctx context.Context, room *Room) error {
+	attrs := ""
+	if len(room.Attributes) > 0 {
+		b, err := json.Marshal(room.Attributes)
+		if err != nil {
+			return err
+		}
+		attrs = string(b)
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE rooms SET name = ?, topic = ?, description = ?, avatar_url = ?, attributes = ?, archived = ? WHERE id = ?`,
+		room.Name, room.Topic, room.Description, room.AvatarURL, attrs, boolToInt(room.Archived), room.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLiteRoomStore) SetDeleted(ctx context.Context, id string, at int64) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE rooms SET deleted_at = ? WHERE id = ?`, at, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLiteRoomStore) ListDeleted(ctx context.Context, before int64) ([]*Room, error) {
+	return s.queryRooms(ctx, `SELECT `+roomColumns+` FROM rooms WHERE deleted_at != 0 AND deleted_at < ? AND purged = 0`, before)
+}
+
+// Purge also clears the room's dm_key, so its former members can open a
+// new conversation with each other.
+func (s *SQLiteRoomStore) Purge(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE rooms SET name = '', members = '', owner_id = '', dm_key = '', topic = '', description = '', avatar_url = '', attributes = '', archived = 0, purged = 1 WHERE id = ? AND deleted_at != 0`, id)
+	return err
+}
+
 func (s *SQLiteRoomStore) AddMember(ctx context.Context, roomID, userID string) error {
 	r, err := s.Get(ctx, roomID)
 	if err != nil {
@@ -255,6 +1064,36 @@ func (s *SQLiteRoomStore) RemoveMember(ctx context.Context, roomID, userID strin
 	return err
 }
 
+// placeholders returns n comma-separated bind parameters for an IN list.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// addColumn adds a column to an existing table if it is not already there,
+// so databases created by older versions pick up new fields.
+func addColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+	return err
+}
+
 func boolToInt(b bool) int {
 	if b {
 		return 1
@@ -0,0 +1,145 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestMessages returns a store holding room r's messages m0 to m4,
+// sent at times 100 to 104, and m5 in another room.
+func newTestMessages(t *testing.T) *SQLiteMessageStore {
+	t.Helper()
+	s, err := NewSQLiteMessageStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 6; i++ {
+		msg := &Message{ID: fmt.Sprintf("m%d", i), UserID: "u", RoomID: "r", Content: "hi", Timestamp: int64(100 + i)}
+		if i == 5 {
+			msg.RoomID = "other"
+		}
+		if err := s.Save(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestExpired(t *testing.T) {
+	s := newTestMessages(t)
+	tests := []struct {
+		name   string
+		before int64
+		keep   int
+		limit  int
+		want   []string
+	}{
+		{"no limits", 0, 0, 10, nil},
+		{"max age", 102, 0, 10, []string{"m0", "m1"}},
+		{"max count", 0, 2, 10, []string{"m0", "m1", "m2"}},
+		{"age removes more", 104, 3, 10, []string{"m0", "m1", "m2", "m3"}},
+		{"count removes more", 101, 2, 10, []string{"m0", "m1", "m2"}},
+		{"keep all", 0, 5, 10, nil},
+		{"batch", 0, 1, 2, []string{"m0", "m1"}},
+	}
+	for _, tt := range tests {
+		got, err := s.Expired(context.Background(), "r", tt.before, tt.keep, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveRecountsReplies(t *testing.T) {
+	tests := []struct {
+		name      string
+		remove    []string
+		wantCount int
+		wantLast  int64
+	}{
+		{"nothing", nil, 2, 202},
+		{"latest reply", []string{"r2"}, 1, 201},
+		{"oldest reply", []string{"r1"}, 1, 202},
+		{"all replies", []string{"r1", "r2"}, 0, 0},
+	}
+	for _, tt := range tests {
+		s := newTestMessages(t)
+		ctx := context.Background()
+		for i, id := range []string{"r1", "r2"} {
+			reply := &Message{ID: id, UserID: "u", RoomID: "r", Content: "re", Timestamp: int64(201 + i), ParentID: "m0"}
+			if err := s.Save(ctx, reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Remove(ctx, tt.remove); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		root, err := s.Get(ctx, "m0")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if root.ReplyCount != tt.wantCount || root.LastReplyAt != tt.wantLast {
+			t.Errorf("%s: got %d replies, last at %d; want %d, %d", tt.name, root.ReplyCount, root.LastReplyAt, tt.wantCount, tt.wantLast)
+		}
+		for _, id := range tt.remove {
+			if _, err := s.Get(ctx, id); err == nil {
+				t.Errorf("%s: %s still there", tt.name, id)
+			}
+		}
+	}
+}
+
+func TestAddSeq(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE messages (id TEXT PRIMARY KEY, user_id TEXT, room_id TEXT, content TEXT, timestamp INTEGER)`,
+		`INSERT INTO messages VALUES ('a', 'u', 'r', 'one', 1), ('b', 'u', 'r', 'two', 2), ('c', 'u', 'r', 'three', 3)`,
+		`DELETE FROM messages WHERE id = 'b'`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	s, err := NewSQLiteMessageStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	want := map[string]int64{"a": 1, "c": 3}
+	for _, vacuum := range []bool{false, true} {
+		if vacuum {
+			if _, err := s.db.Exec(`VACUUM`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for id, seq := range want {
+			msg, err := s.Get(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Seq != seq || msg.Content == "" {
+				t.Errorf("vacuum %v: %s got seq %d, want %d", vacuum, id, msg.Seq, seq)
+			}
+		}
+	}
+	msg := &Message{ID: "d", UserID: "u", RoomID: "r", Content: "four", Timestamp: 4}
+	if err := s.Save(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Seq != 4 {
+		t.Errorf("new message got seq %d, want 4", msg.Seq)
+	}
+}
@@ -0,0 +1,96 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Pin marks a message its room wants to keep in view.
+type Pin struct {
+	MessageID string
+	RoomID    string
+	PinnedBy  string
+	PinnedAt  int64
+	Message   *Message `json:",omitempty"`
+}
+
+type PinStore interface {
+	// Add and Remove report whether anything changed.
+	Add(ctx context.Context, p *Pin) (bool, error)
+	Remove(ctx context.Context, roomID, messageID string) (bool, error)
+	// ListByRoom returns roomID's pins, the most recent first.
+	ListByRoom(ctx context.Context, roomID string) ([]*Pin, error)
+	// CountByRoom counts roomID's pins of messages that are still there,
+	// not deleted or expired.
+	CountByRoom(ctx context.Context, roomID string) (int, error)
+	DeleteByMessages(ctx context.Context, messageIDs []string) error
+}
+
+type SQLitePinStore struct {
+	db *sql.DB
+}
+
+func NewSQLitePinStore(dsn string) (*SQLitePinStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pins (room_id TEXT, message_id TEXT, pinned_by TEXT, pinned_at INTEGER, PRIMARY KEY (room_id, message_id))`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLitePinStore{db: db}, nil
+}
+
+func (s *SQLitePinStore) Add(ctx context.Context, p *Pin) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO pins (room_id, message_id, pinned_by, pinned_at) VALUES (?, ?, ?, ?)`, p.RoomID, p.MessageID, p.PinnedBy, p.PinnedAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLitePinStore) Remove(ctx context.Context, roomID, messageID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM pins WHERE room_id = ? AND message_id = ?`, roomID, messageID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLitePinStore) ListByRoom(ctx context.Context, roomID string) ([]*Pin, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT room_id, message_id, pinned_by, pinned_at FROM pins WHERE room_id = ? ORDER BY pinned_at DESC, rowid DESC`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pins []*Pin
+	for rows.Next() {
+		var p Pin
+		if err := rows.Scan(&p.RoomID, &p.MessageID, &p.PinnedBy, &p.PinnedAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, &p)
+	}
+	return pins, rows.Err()
+}
+
+func (s *SQLitePinStore) CountByRoom(ctx context.Context, roomID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pins WHERE room_id = ? AND message_id IN (SELECT id FROM messages WHERE deleted = 0 AND `+unexpired+`)`, roomID).Scan(&n)
+	return n, err
+}
+
+func (s *SQLitePinStore) DeleteByMessages(ctx context.Context, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM pins WHERE message_id IN (`+placeholders(len(messageIDs))+`)`, args...)
+	return err
+}
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Reaction is one user's emoji reaction to a message. A user can react
+// with several different emoji but each only once.
+type Reaction struct {
+	MessageID string
+	RoomID    string `json:",omitempty"`
+	UserID    string
+	Emoji     string
+	CreatedAt int64
+}
+
+// ReactionCount aggregates the reactions a message got with one emoji.
+type ReactionCount struct {
+	Emoji   string
+	Count   int
+	UserIDs []string
+}
+
+type ReactionStore interface {
+	// Add and Remove report whether anything changed.
+	Add(ctx context.Context, r *Reaction) (bool, error)
+	Remove(ctx context.Context, messageID, userID, emoji string) (bool, error)
+	// Counts returns the reactions of each message in messageIDs, in the
+	// order each emoji was first used.
+	Counts(ctx context.Context, messageIDs []string) (map[string][]ReactionCount, error)
+	DeleteByMessages(ctx context.Context, messageIDs []string) error
+}
+
+type SQLiteReactionStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteReactionStore(dsn string) (*SQLiteReactionStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS reactions (message_id TEXT, user_id TEXT, emoji TEXT, created_at INTEGER, PRIMARY KEY (message_id, user_id, emoji))`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteReactionStore{db: db}, nil
+}
+
+func (s *SQLiteReactionStore) Add(ctx context.Context, r *Reaction) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO reactions (message_id, user_id, emoji, created_at) VALUES (?, ?, ?, ?)`, r.MessageID, r.UserID, r.Emoji, r.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteReactionStore) Remove(ctx context.Context, messageID, userID, emoji string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`, messageID, userID, emoji)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteReactionStore) Counts(ctx context.Context, messageIDs []string) (map[string][]ReactionCount, error) {
+	counts := make(map[string][]ReactionCount)
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT message_id, emoji, user_id FROM reactions WHERE message_id IN (`+placeholders(len(messageIDs))+`) ORDER BY created_at, rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID, emoji, userID string
+		if err := rows.Scan(&messageID, &emoji, &userID); err != nil {
+			return nil, err
+		}
+		cs := counts[messageID]
+		i := 0
+		for i < len(cs) && cs[i].Emoji != emoji {
+			i++
+		}
+		if i == len(cs) {
+			cs = append(cs, ReactionCount{Emoji: emoji})
+		}
+		cs[i].Count++
+		cs[i].UserIDs = append(cs[i].UserIDs, userID)
+		counts[messageID] = cs
+	}
+	return counts, rows.Err()
+}
+
+func (s *SQLiteReactionStore) DeleteByMessages(ctx context.Context, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM reactions WHERE message_id IN (`+placeholders(len(messageIDs))+`)`, args...)
+	return err
+}
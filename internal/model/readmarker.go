@@ -0,0 +1,89 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+// ReadMarker records the last message a user has read in a room.
+type ReadMarker struct {
+	UserID    string
+	RoomID    string
+	MessageID string
+	Seq       int64
+	Timestamp int64
+}
+
+type UnreadCount struct {
+	RoomID            string
+	Unread            int
+	LastReadMessageID string `json:",omitempty"`
+	LastReadSeq       int64
+}
+
+type ReadMarkerStore interface {
+	// Advance moves the marker forward; markers never move back to an
+	// older message. It reports whether the marker changed.
+	Advance(ctx context.Context, m *ReadMarker) (bool, error)
+	Get(ctx context.Context, userID, roomID string) (*ReadMarker, error)
+	ListByRoom(ctx context.Context, roomID string) ([]*ReadMarker, error)
+	DeleteByRoom(ctx context.Context, roomID string) error
+}
+
+type SQLiteReadMarkerStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteReadMarkerStore(dsn string) (*SQLiteReadMarkerStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS read_markers (user_id TEXT, room_id TEXT, message_id TEXT, seq INTEGER, timestamp INTEGER, PRIMARY KEY (user_id, room_id))`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteReadMarkerStore{db: db}, nil
+}
+
+func (s *SQLiteReadMarkerStore) Advance(ctx context.Context, m *ReadMarker) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO read_markers (user_id, room_id, message_id, seq, timestamp) VALUES (?, ?, ?, ?, ?) ON CONFLICT(user_id, room_id) DO UPDATE SET message_id = excluded.message_id, seq = excluded.seq, timestamp = excluded.timestamp WHERE excluded.seq > read_markers.seq`, m.UserID, m.RoomID, m.MessageID, m.Seq, m.Timestamp)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteReadMarkerStore) Get(ctx context.Context, userID, roomID string) (*ReadMarker, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT user_id, room_id, message_id, seq, timestamp FROM read_markers WHERE user_id = ? AND room_id = ?`, userID, roomID)
+	var m ReadMarker
+	err := row.Scan(&m.UserID, &m.RoomID, &m.MessageID, &m.Seq, &m.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *SQLiteReadMarkerStore) ListByRoom(ctx context.Context, roomID string) ([]*ReadMarker, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id, room_id, message_id, seq, timestamp FROM read_markers WHERE room_id = ? ORDER BY seq DESC`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ms []*ReadMarker
+	for rows.Next() {
+		var m ReadMarker
+		err := rows.Scan(&m.UserID, &m.RoomID, &m.MessageID, &m.Seq, &m.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, &m)
+	}
+	return ms, nil
+}
+
+func (s *SQLiteReadMarkerStore) DeleteByRoom(ctx context.Context, roomID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM read_markers WHERE room_id = ?`, roomID)
+	return err
+}
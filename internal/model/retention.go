@@ -0,0 +1,91 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+// RetentionPolicy limits how long a room keeps its messages. The policy
+// with an empty RoomID is the global one, used by rooms without their own.
+// A room under LegalHold keeps everything whatever its limits say.
+type RetentionPolicy struct {
+	RoomID    string `json:",omitempty"`
+	MaxAge    int64  // seconds; 0 keeps messages regardless of age
+	MaxCount  int    // 0 keeps messages regardless of count
+	LegalHold bool
+	UpdatedBy string `json:",omitempty"`
+	UpdatedAt int64  `json:",omitempty"`
+}
+
+type RetentionStore interface {
+	Get(ctx context.Context, roomID string) (*RetentionPolicy, error)
+	List(ctx context.Context) ([]*RetentionPolicy, error)
+	Set(ctx context.Context, p *RetentionPolicy) error
+	// Delete reports whether there was a policy to remove.
+	Delete(ctx context.Context, roomID string) (bool, error)
+}
+
+type SQLiteRetentionStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteRetentionStore(dsn string) (*SQLiteRetentionStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS retention_policies (room_id TEXT PRIMARY KEY, max_age INTEGER, max_count INTEGER, legal_hold INTEGER, updated_by TEXT, updated_at INTEGER)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteRetentionStore{db: db}, nil
+}
+
+const retentionColumns = `room_id, max_age, max_count, legal_hold, updated_by, updated_at`
+
+func (s *SQLiteRetentionStore) Get(ctx context.Context, roomID string) (*RetentionPolicy, error) {
+	return scanRetention(s.db.QueryRowContext(ctx, `SELECT `+retentionColumns+` FROM retention_policies WHERE room_id = ?`, roomID))
+}
+
+func (s *SQLiteRetentionStore) List(ctx context.Context) ([]*RetentionPolicy, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+retentionColumns+` FROM retention_policies ORDER BY room_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ps []*RetentionPolicy
+	for rows.Next() {
+		p, err := scanRetention(rows)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, rows.Err()
+}
+
+func (s *SQLiteRetentionStore) Set(ctx context.Context, p *RetentionPolicy) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO retention_policies (`+retentionColumns+`) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT(room_id) DO UPDATE SET max_age = excluded.max_age, max_count = excluded.max_count, legal_hold = excluded.legal_hold, updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		p.RoomID, p.MaxAge, p.MaxCount, boolToInt(p.LegalHold), p.UpdatedBy, p.UpdatedAt)
+	return err
+}
+
+func (s *SQLiteRetentionStore) Delete(ctx context.Context, roomID string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM retention_policies WHERE room_id = ?`, roomID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func scanRetention(row rowScanner) (*RetentionPolicy, error) {
+	var p RetentionPolicy
+	var hold int
+	err := row.Scan(&p.RoomID, &p.MaxAge, &p.MaxCount, &hold, &p.UpdatedBy, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.LegalHold = hold == 1
+	return &p, nil
+}
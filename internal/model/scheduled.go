@@ -0,0 +1,205 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+)
+
+// ScheduledMessage is a message waiting to be sent at SendAt. Once it
+// goes out, the events about it carry the ID of the message it became, or
+// why it could not be sent. Attempts counts failed tries to send it.
+type ScheduledMessage struct {
+	ID            string
+	UserID        string
+	RoomID        string
+	Content       string
+	Type          ContentType     `json:",omitempty"`
+	Body          json.RawMessage `json:",omitempty"`
+	ParentID      string          `json:",omitempty"`
+	TTL           int64           `json:",omitempty"`
+	ExpireMode    ExpireMode      `json:",omitempty"`
+	AttachmentIDs []string        `json:",omitempty"`
+	SendAt        int64
+	CreatedAt     int64
+	UpdatedAt     int64  `json:",omitempty"`
+	Attempts      int    `json:",omitempty"`
+	MessageID     string `json:",omitempty"`
+	Error         string `json:",omitempty"`
+}
+
+// Message is the chat message sm will be sent as.
+func (sm *ScheduledMessage) Message() *Message {
+	return &Message{
+		UserID:     sm.UserID,
+		RoomID:     sm.RoomID,
+		Content:    sm.Content,
+		Type:       sm.Type,
+		Body:       sm.Body,
+		ParentID:   sm.ParentID,
+		TTL:        sm.TTL,
+		ExpireMode: sm.ExpireMode,
+	}
+}
+
+type ScheduledStore interface {
+	Create(ctx context.Context, sm *ScheduledMessage) error
+	Get(ctx context.Context, id string) (*ScheduledMessage, error)
+	ListByUser(ctx context.Context, userID string) ([]*ScheduledMessage, error)
+	CountByUser(ctx context.Context, userID string) (int, error)
+	// Update rewrites a pending message; sql.ErrNoRows means it is being
+	// sent or has already been sent or cancelled.
+	Update(ctx context.Context, sm *ScheduledMessage) error
+	// Cancel removes a pending message that is not being sent and reports
+	// whether it was still there.
+	Cancel(ctx context.Context, id string) (bool, error)
+	// Claim marks a message as being sent at now and reports whether the
+	// caller got it. A claim made before stale is taken to have been
+	// abandoned and can be claimed again.
+	Claim(ctx context.Context, id string, now, stale int64) (bool, error)
+	// Release gives up a claim after a failed try, to be retried at sendAt.
+	Release(ctx context.Context, id string, sendAt int64) error
+	// Delete removes a message once it has been sent or has failed for good.
+	Delete(ctx context.Context, id string) error
+	// Due returns up to limit unclaimed messages whose SendAt is not after
+	// now, earliest first, counting claims made before stale as unclaimed.
+	Due(ctx context.Context, now, stale int64, limit int) ([]*ScheduledMessage, error)
+	DeleteByRoom(ctx context.Context, roomID string) error
+}
+
+type SQLiteScheduledStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteScheduledStore(dsn string) (*SQLiteScheduledStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS scheduled_messages (id TEXT PRIMARY KEY, user_id TEXT, room_id TEXT, content TEXT, type TEXT, body TEXT, parent_id TEXT, ttl INTEGER, expire_mode TEXT, attachment_ids TEXT, send_at INTEGER, created_at INTEGER, updated_at INTEGER)`)
+	if err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "scheduled_messages", "claimed_at", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "scheduled_messages", "attempts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS scheduled_messages_send_at ON scheduled_messages (send_at)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS scheduled_messages_user ON scheduled_messages (user_id, send_at)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteScheduledStore{db: db}, nil
+}
+
+const scheduledColumns = `id, user_id, room_id, content, type, body, parent_id, ttl, expire_mode, attachment_ids, send_at, created_at, updated_at, attempts`
+
+func (s *SQLiteScheduledStore) Create(ctx context.Context, sm *ScheduledMessage) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO scheduled_messages (`+scheduledColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sm.ID, sm.UserID, sm.RoomID, sm.Content, sm.Type, string(sm.Body), sm.ParentID, sm.TTL, sm.ExpireMode,
+		strings.Join(sm.AttachmentIDs, ","), sm.SendAt, sm.CreatedAt, sm.UpdatedAt, sm.Attempts)
+	return err
+}
+
+func (s *SQLiteScheduledStore) Get(ctx context.Context, id string) (*ScheduledMessage, error) {
+	return scanScheduled(s.db.QueryRowContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_messages WHERE id = ?`, id))
+}
+
+func (s *SQLiteScheduledStore) ListByUser(ctx context.Context, userID string) ([]*ScheduledMessage, error) {
+	return s.query(ctx, `SELECT `+scheduledColumns+` FROM scheduled_messages WHERE user_id = ? ORDER BY send_at, rowid`, userID)
+}
+
+func (s *SQLiteScheduledStore) CountByUser(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM scheduled_messages WHERE user_id = ?`, userID).Scan(&n)
+	return n, err
+}
+
+func (s *SQLiteScheduledStore) Update(ctx context.Context, sm *ScheduledMessage) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE scheduled_messages SET content = ?, type = ?, body = ?, ttl = ?, expire_mode = ?, send_at = ?, updated_at = ? WHERE id = ? AND claimed_at = 0`,
+		sm.Content, sm.Type, string(sm.Body), sm.TTL, sm.ExpireMode, sm.SendAt, sm.UpdatedAt, sm.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLiteScheduledStore) Cancel(ctx context.Context, id string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_messages WHERE id = ? AND claimed_at = 0`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteScheduledStore) Claim(ctx context.Context, id string, now, stale int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE scheduled_messages SET claimed_at = ? WHERE id = ? AND claimed_at < ?`, now, id, stale)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteScheduledStore) Release(ctx context.Context, id string, sendAt int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE scheduled_messages SET claimed_at = 0, attempts = attempts + 1, send_at = ? WHERE id = ?`, sendAt, id)
+	return err
+}
+
+func (s *SQLiteScheduledStore) Delete(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_messages WHERE id = ?`, id)
+	return err
+}
+
+func (s *SQLiteScheduledStore) Due(ctx context.Context, now, stale int64, limit int) ([]*ScheduledMessage, error) {
+	return s.query(ctx, `SELECT `+scheduledColumns+` FROM scheduled_messages WHERE send_at <= ? AND claimed_at < ? ORDER BY send_at, rowid LIMIT ?`, now, stale, limit)
+}
+
+func (s *SQLiteScheduledStore) DeleteByRoom(ctx context.Context, roomID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_messages WHERE room_id = ?`, roomID)
+	return err
+}
+
+func (s *SQLiteScheduledStore) query(ctx context.Context, query string, args ...interface{}) ([]*ScheduledMessage, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*ScheduledMessage
+	for rows.Next() {
+		sm, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sm)
+	}
+	return list, rows.Err()
+}
+
+func scanScheduled(row rowScanner) (*ScheduledMessage, error) {
+	var sm ScheduledMessage
+	var body, attachments string
+	err := row.Scan(&sm.ID, &sm.UserID, &sm.RoomID, &sm.Content, &sm.Type, &body, &sm.ParentID, &sm.TTL, &sm.ExpireMode,
+		&attachments, &sm.SendAt, &sm.CreatedAt, &sm.UpdatedAt, &sm.Attempts)
+	if err != nil {
+		return nil, err
+	}
+	if body != "" {
+		sm.Body = json.RawMessage(body)
+	}
+	if attachments != "" {
+		sm.AttachmentIDs = strings.Split(attachments, ",")
+	}
+	return &sm, nil
+}
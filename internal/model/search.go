@@ -0,0 +1,307 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SearchQuery describes a message search. Text is matched as a set of
+// words that must all appear; RoomIDs limits the search to those rooms
+// and must not be empty.
+type SearchQuery struct {
+	Text     string
+	RoomIDs  []string
+	AuthorID string
+	// After and Before bound the message timestamp, inclusive and
+	// exclusive. Zero means unbounded.
+	After  int64
+	Before int64
+	// BeforeSeq continues a previous page: only messages older than it
+	// are returned.
+	BeforeSeq int64
+	Limit     int
+}
+
+// SearchResult is a matching message with an HTML snippet of its content
+// in which the matched words are wrapped in <mark>.
+type SearchResult struct {
+	Message *Message
+	Snippet string
+}
+
+type SearchPage struct {
+	Results []*SearchResult
+	// NextCursor fetches the next page when passed back as the cursor;
+	// it is empty on the last page. It is the BeforeSeq to use.
+	NextCursor string `json:",omitempty"`
+}
+
+// SearchIndex finds messages by their content. Backends that keep their
+// own copy of messages are told about every save, edit and deletion
+// through Index and Remove; the SQLite ones read the messages table and
+// embed tableSearch instead. Results come back newest first.
+type SearchIndex interface {
+	Index(ctx context.Context, msg *Message) error
+	Remove(ctx context.Context, messageID string) error
+	Search(ctx context.Context, q *SearchQuery) (*SearchPage, error)
+}
+
+// tableSearch is the Index and Remove of a backend that reads the
+// messages table itself, where there is nothing to do.
+type tableSearch struct{}
+
+func (tableSearch) Index(ctx context.Context, msg *Message) error { return nil }
+
+func (tableSearch) Remove(ctx context.Context, messageID string) error { return nil }
+
+// FTS5Available reports whether this build of go-sqlite3 has FTS5, which
+// takes the sqlite_fts5 build tag.
+func FTS5Available() bool {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE VIRTUAL TABLE fts5_probe USING fts5(x)`)
+	return err == nil
+}
+
+// SQLiteFTSIndex searches messages with an FTS5 table that triggers keep
+// in sync with the messages table, so Index and Remove have nothing to
+// do. It needs FTS5; see SQLiteLikeIndex for builds without it.
+type SQLiteFTSIndex struct {
+	tableSearch
+	db *sql.DB
+}
+
+func NewSQLiteFTSIndex(dsn string) (*SQLiteFTSIndex, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Without the table or its triggers the index is missing or stale and
+	// has to be rebuilt once they are in place.
+	var existing int
+	err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_fts' OR (type = 'trigger' AND name LIKE 'messages_fts_%')`).Scan(&existing)
+	if err != nil {
+		return nil, err
+	}
+	stmts := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, content='messages', content_rowid='seq')`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, content) VALUES (new.seq, new.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.seq, old.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.seq, old.content);
+			INSERT INTO messages_fts (rowid, content) VALUES (new.seq, new.content);
+		END`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if existing < 4 {
+		if _, err := db.Exec(`INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')`); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLiteFTSIndex{db: db}, nil
+}
+
+func (s *SQLiteFTSIndex) Search(ctx context.Context, q *SearchQuery) (*SearchPage, error) {
+	terms := searchTerms(q.Text)
+	if len(terms) == 0 || len(q.RoomIDs) == 0 {
+		return &SearchPage{Results: []*SearchResult{}}, nil
+	}
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+	where, args := searchFilters(q)
+	query := `SELECT ` + qualifiedMessageColumns + ` FROM messages_fts JOIN messages m ON m.seq = messages_fts.rowid WHERE messages_fts MATCH ?` + where
+	return runSearch(ctx, s.db, q, terms, query, append([]interface{}{strings.Join(quoted, " ")}, args...))
+}
+
+// SQLiteLikeIndex searches message content with LIKE. It scans every
+// message in the caller's rooms, so it suits small deployments and builds
+// without FTS5.
+type SQLiteLikeIndex struct {
+	tableSearch
+	db *sql.DB
+}
+
+// NewSQLiteLikeIndex drops the FTS triggers a build with FTS5 may have
+// left behind: without the module they would make every write fail. It
+// must run before anything else opens the database, since a connection
+// that has already loaded the triggers keeps failing after they are gone.
+func NewSQLiteLikeIndex(dsn string) (*SQLiteLikeIndex, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range []string{"insert", "delete", "update"} {
+		if _, err := db.Exec(`DROP TRIGGER IF EXISTS messages_fts_` + t); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLiteLikeIndex{db: db}, nil
+}
+
+func (s *SQLiteLikeIndex) Search(ctx context.Context, q *SearchQuery) (*SearchPage, error) {
+	terms := searchTerms(q.Text)
+	if len(terms) == 0 || len(q.RoomIDs) == 0 {
+		return &SearchPage{Results: []*SearchResult{}}, nil
+	}
+	var like []string
+	var args []interface{}
+	for _, t := range terms {
+		like = append(like, `m.content LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(t)+"%")
+	}
+	where, fargs := searchFilters(q)
+	query := `SELECT ` + qualifiedMessageColumns + ` FROM messages m WHERE ` + strings.Join(like, " AND ") + where
+	return runSearch(ctx, s.db, q, terms, query, append(args, fargs...))
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+var qualifiedMessageColumns = "m." + strings.ReplaceAll(messageColumns, ", ", ", m.")
+
+// searchFilters builds the conditions every backend applies on top of
+// matching the text.
+func searchFilters(q *SearchQuery) (string, []interface{}) {
+	var b strings.Builder
+	var args []interface{}
+	b.WriteString(` AND m.deleted = 0 AND (m.expires_at = 0 OR m.expires_at > unixepoch()) AND m.room_id IN (` + placeholders(len(q.RoomIDs)) + `)`)
+	for _, id := range q.RoomIDs {
+		args = append(args, id)
+	}
+	if q.AuthorID != "" {
+		b.WriteString(` AND m.user_id = ?`)
+		args = append(args, q.AuthorID)
+	}
+	if q.After > 0 {
+		b.WriteString(` AND m.timestamp >= ?`)
+		args = append(args, q.After)
+	}
+	if q.Before > 0 {
+		b.WriteString(` AND m.timestamp < ?`)
+		args = append(args, q.Before)
+	}
+	if q.BeforeSeq > 0 {
+		b.WriteString(` AND m.seq < ?`)
+		args = append(args, q.BeforeSeq)
+	}
+	return b.String(), args
+}
+
+func runSearch(ctx context.Context, db *sql.DB, q *SearchQuery, terms []string, query string, args []interface{}) (*SearchPage, error) {
+	rows, err := db.QueryContext(ctx, query+` ORDER BY m.seq DESC LIMIT ?`, append(args, q.Limit+1)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := &SearchPage{Results: []*SearchResult{}}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Results) == q.Limit {
+			page.NextCursor = strconv.FormatInt(page.Results[len(page.Results)-1].Message.Seq, 10)
+			break
+		}
+		page.Results = append(page.Results, &SearchResult{Message: m, Snippet: Snippet(m.Content, terms)})
+	}
+	return page, rows.Err()
+}
+
+// searchTerms splits free text into the words to look for.
+func searchTerms(text string) []string {
+	var terms []string
+	for _, f := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_'
+	}) {
+		terms = append(terms, f)
+		if len(terms) == 16 {
+			break
+		}
+	}
+	return terms
+}
+
+// snippetRadius is how much context, in bytes, a snippet keeps around
+// the first match.
+const snippetRadius = 60
+
+// Snippet cuts an excerpt of content around the first matched term,
+// HTML-escapes it and wraps every occurrence of a term in <mark>.
+func Snippet(content string, terms []string) string {
+	lower := strings.ToLower(content)
+	if len(lower) != len(content) {
+		// A few runes change length when lowered; match case-sensitively
+		// rather than misalign the two.
+		lower = content
+	}
+	lowerTerms := make([]string, len(terms))
+	for i, t := range terms {
+		lowerTerms[i] = strings.ToLower(t)
+	}
+	first := -1
+	for _, t := range lowerTerms {
+		if i := strings.Index(lower, t); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	start, end := 0, len(content)
+	if first > snippetRadius {
+		start = first - snippetRadius
+	}
+	if end-first > 2*snippetRadius {
+		end = first + 2*snippetRadius
+	}
+	if first < 0 {
+		start, end = 0, min(len(content), 2*snippetRadius)
+	}
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end++
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	excerpt, lowerExcerpt := content[start:end], lower[start:end]
+	for i := 0; i < len(excerpt); {
+		n := 0
+		for _, t := range lowerTerms {
+			if strings.HasPrefix(lowerExcerpt[i:], t) && len(t) > n {
+				n = len(t)
+			}
+		}
+		if n > 0 {
+			b.WriteString("<mark>" + html.EscapeString(excerpt[i:i+n]) + "</mark>")
+			i += n
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(excerpt[i:])
+		b.WriteString(html.EscapeString(excerpt[i : i+size]))
+		i += size
+	}
+	if end < len(content) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+type UserStore interface {
+	Create(ctx context.Context, u *User) error
+	Get(ctx context.Context, id string) (*User, error)
+	GetByName(ctx context.Context, name string) (*User, error)
+	SetDisabled(ctx context.Context, id string, disabled bool) error
+	GetByIdentity(ctx context.Context, issuer, subject string) (*User, error)
+	// CreateWithIdentity creates u already linked to an IdP identity;
+	// either both are stored or neither is.
+	CreateWithIdentity(ctx context.Context, u *User, issuer, subject string) error
+}
+
+type SQLiteUserStore struct {
+	db *sql.DB
+}
+
+const userColumns = `id, name, display_name, password_hash, disabled, service_account, created_at`
+
+func NewSQLiteUserStore(dsn string) (*SQLiteUserStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (id TEXT PRIMARY KEY, name TEXT UNIQUE COLLATE NOCASE, display_name TEXT, password_hash TEXT, disabled INTEGER, created_at INTEGER)`)
+	if err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "users", "service_account", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_identities (issuer TEXT, subject TEXT, user_id TEXT, PRIMARY KEY (issuer, subject))`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteUserStore{db: db}, nil
+}
+
+func (s *SQLiteUserStore) Create(ctx context.Context, u *User) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`, u.ID, u.Name, u.DisplayName, u.PasswordHash, boolToInt(u.Disabled), boolToInt(u.ServiceAccount), u.CreatedAt)
+	return err
+}
+
+func (s *SQLiteUserStore) Get(ctx context.Context, id string) (*User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+func (s *SQLiteUserStore) GetByName(ctx context.Context, name string) (*User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE name = ?`, name))
+}
+
+func (s *SQLiteUserStore) SetDisabled(ctx context.Context, id string, disabled bool) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET disabled = ? WHERE id = ?`, boolToInt(disabled), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLiteUserStore) GetByIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = (SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?)`, issuer, subject))
+}
+
+func (s *SQLiteUserStore) CreateWithIdentity(ctx context.Context, u *User, issuer, subject string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`, u.ID, u.Name, u.DisplayName, u.PasswordHash, boolToInt(u.Disabled), boolToInt(u.ServiceAccount), u.CreatedAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO user_identities (issuer, subject, user_id) VALUES (?, ?, ?)`, issuer, subject, u.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func scanUser(row *sql.Row) (*User, error) {
+	var u User
+	var disabled, service int
+	err := row.Scan(&u.ID, &u.Name, &u.DisplayName, &u.PasswordHash, &disabled, &service, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	u.Disabled = disabled == 1
+	u.ServiceAccount = service == 1
+	return &u, nil
+}
@@ -0,0 +1,42 @@
+package model
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateWithIdentity(t *testing.T) {
+	s, err := NewSQLiteUserStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		user    *User
+		subject string
+		wantErr bool
+	}{
+		{"new identity", &User{ID: "a", Name: "alice"}, "sub-a", false},
+		{"identity already linked", &User{ID: "b", Name: "bob"}, "sub-a", true},
+		{"name taken", &User{ID: "c", Name: "alice"}, "sub-c", true},
+	}
+	for _, tt := range tests {
+		err := s.CreateWithIdentity(ctx, tt.user, "https://idp", tt.subject)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		_, getErr := s.Get(ctx, tt.user.ID)
+		if created := getErr == nil; created == tt.wantErr {
+			t.Errorf("%s: user created %v", tt.name, created)
+		}
+	}
+	u, err := s.GetByIdentity(ctx, "https://idp", "sub-a")
+	if err != nil || u.ID != "a" {
+		t.Errorf("sub-a: got %+v, %v", u, err)
+	}
+	if _, err := s.GetByIdentity(ctx, "https://idp", "sub-c"); err == nil {
+		t.Error("sub-c: linked without a user")
+	}
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name string
+		l    *Limiter
+		keys []string
+		want []bool
+	}{
+		{"burst then empty", New(1, 2), []string{"a", "a", "a"}, []bool{true, true, false}},
+		{"keys apart", New(1, 1), []string{"a", "b", "a", "b"}, []bool{true, true, false, false}},
+		{"burst at least one", New(1, 0), []string{"a", "a"}, []bool{true, false}},
+		{"disabled", New(0, 1), []string{"a", "a", "a"}, []bool{true, true, true}},
+		{"nil", nil, []string{"a", "a"}, []bool{true, true}},
+	}
+	for _, tt := range tests {
+		for i, key := range tt.keys {
+			ok, wait := tt.l.Allow(key)
+			if ok != tt.want[i] {
+				t.Errorf("%s: call %d: got %v, want %v", tt.name, i, ok, tt.want[i])
+			}
+			if ok && wait != 0 || !ok && (wait <= 0 || wait > time.Second) {
+				t.Errorf("%s: call %d: got wait %v", tt.name, i, wait)
+			}
+		}
+	}
+}
+
+func TestAllowRefills(t *testing.T) {
+	l := New(50, 1)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("first call refused")
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("empty bucket allowed")
+	}
+	time.Sleep(wait)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("still refused after %v", wait)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want int
+	}{
+		{0, 1},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{10 * time.Second, 10},
+	}
+	for _, tt := range tests {
+		if got := RetryAfter(tt.wait); got != tt.want {
+			t.Errorf("RetryAfter(%v) = %d, want %d", tt.wait, got, tt.want)
+		}
+	}
+}
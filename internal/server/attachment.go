@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/1cbyc/go-websocket-server/internal/blob"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// maxAttachments caps how many files one message can carry.
+const maxAttachments = 10
+
+// uploadSweepBatch is how many unsent uploads are removed at a time.
+const uploadSweepBatch = 500
+
+var (
+	ErrUploadTooLarge     = errors.New("file too large")
+	ErrUnsupportedType    = errors.New("file type not allowed")
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrInvalidAttachments = errors.New("invalid attachments")
+)
+
+// Upload stores a file userID is about to send to roomID. The type is
+// sniffed from the content rather than taken from the client. Images get
+// a thumbnail when they can be decoded. Anyone who may post to roomID
+// may upload to it.
+func (s *Server) Upload(ctx context.Context, userID, roomID, name string, r io.Reader) (*model.Attachment, error) {
+	if !s.CanAccess(ctx, userID, roomID) {
+		return nil, ErrForbidden
+	}
+	if err := s.checkOpen(ctx, roomID); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !s.uploadAllowed(mimeType) {
+		return nil, ErrUnsupportedType
+	}
+	a := &model.Attachment{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		RoomID:    roomID,
+		Name:      cleanFileName(name),
+		MIMEType:  mimeType,
+		CreatedAt: time.Now().Unix(),
+	}
+	max := int64(s.cfg.MaxUploadBytes)
+	var err error
+	a.Size, err = s.blobs.Put(ctx, a.ID, io.LimitReader(br, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if a.Size > max {
+		s.blobs.Delete(ctx, a.ID)
+		return nil, ErrUploadTooLarge
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		s.thumbnail(ctx, a)
+	}
+	if err := s.attachments.Create(ctx, a); err != nil {
+		s.blobs.Delete(ctx, a.ID)
+		s.blobs.Delete(ctx, a.ID+".thumb")
+		return nil, err
+	}
+	return a, nil
+}
+
+// thumbnail stores a scaled-down copy of image attachment a and records
+// its dimensions. Images that cannot be decoded just go without.
+func (s *Server) thumbnail(ctx context.Context, a *model.Attachment) {
+	rc, err := s.blobs.Open(ctx, a.ID)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	thumb, _, w, h, err := blob.Thumbnail(rc)
+	a.Width, a.Height = w, h
+	if err != nil {
+		return
+	}
+	if _, err := s.blobs.Put(ctx, a.ID+".thumb", bytes.NewReader(thumb)); err != nil {
+		s.log.Error("failed to store thumbnail", zap.Error(err))
+		return
+	}
+	a.HasThumbnail = true
+}
+
+func (s *Server) uploadAllowed(mimeType string) bool {
+	for _, t := range s.cfg.UploadTypes {
+		if t == mimeType || t == "*/*" {
+			return true
+		}
+		if family, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(mimeType, family+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenAttachment returns attachment id and its content, or its thumbnail,
+// if userID may see it: they must be able to read its room, and until it
+// is sent only the uploader can fetch it. Attachments of deleted messages are
+// gone.
+func (s *Server) OpenAttachment(ctx context.Context, userID, id string, thumb bool) (*model.Attachment, io.ReadCloser, error) {
+	a, err := s.attachments.Get(ctx, id)
+	if err != nil {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	if !s.CanAccess(ctx, userID, a.RoomID) {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	if a.MessageID == "" && a.UserID != userID {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	if a.MessageID != "" {
+		if msg, err := s.store.Get(ctx, a.MessageID); err != nil || msg.Deleted {
+			return nil, nil, ErrAttachmentNotFound
+		}
+	}
+	key := a.ID
+	if thumb {
+		if !a.HasThumbnail {
+			return nil, nil, ErrAttachmentNotFound
+		}
+		key += ".thumb"
+	}
+	rc, err := s.blobs.Open(ctx, key)
+	if err != nil {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	return a, rc, nil
+}
+
+// FillMessages fills in the aggregated reactions and the attachments of
+// msgs. Deleted messages keep neither.
+func (s *Server) FillMessages(ctx context.Context, msgs ...*model.Message) {
+	ids := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		if m != nil && !m.Deleted {
+			ids = append(ids, m.ID)
+		}
+	}
+	counts, err := s.reactions.Counts(ctx, ids)
+	if err != nil {
+		s.log.Error("failed to load reactions", zap.Error(err))
+		return
+	}
+	files, err := s.attachments.ListByMessages(ctx, ids)
+	if err != nil {
+		s.log.Error("failed to load attachments", zap.Error(err))
+		return
+	}
+	for _, m := range msgs {
+		if m != nil && !m.Deleted {
+			m.Reactions = counts[m.ID]
+			m.Attachments = files[m.ID]
+		}
+	}
+}
+
+// attach links the uploaded files ids to msg and fills in its
+// attachments.
+func (s *Server) attach(ctx context.Context, msg *model.Message, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(ids) > maxAttachments {
+		return ErrInvalidAttachments
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			return ErrInvalidAttachments
+		}
+		seen[id] = true
+	}
+	if err := s.attachments.Attach(ctx, ids, msg.ID, msg.UserID, msg.RoomID); err != nil {
+		return ErrInvalidAttachments
+	}
+	byMessage, err := s.attachments.ListByMessages(ctx, []string{msg.ID})
+	if err != nil {
+		return err
+	}
+	msg.Attachments = byMessage[msg.ID]
+	return nil
+}
+
+// sweepUploads deletes files that were uploaded more than UploadTTL ago
+// but never sent.
+func (s *Server) sweepUploads(ctx context.Context) {
+	if s.cfg.UploadTTL <= 0 {
+		return
+	}
+	before := time.Now().Add(-s.cfg.UploadTTL).Unix()
+	for {
+		removed, err := s.attachments.DeleteUnattached(ctx, before, uploadSweepBatch)
+		if err != nil {
+			s.log.Error("failed to sweep unsent uploads", zap.Error(err))
+			return
+		}
+		s.deleteFiles(ctx, removed)
+		if len(removed) < uploadSweepBatch {
+			return
+		}
+	}
+}
+
+// deleteFiles removes the stored files, and thumbnails, of attachments
+// that are gone.
+func (s *Server) deleteFiles(ctx context.Context, removed []*model.Attachment) {
+	for _, a := range removed {
+		s.blobs.Delete(ctx, a.ID)
+		if a.HasThumbnail {
+			s.blobs.Delete(ctx, a.ID+".thumb")
+		}
+	}
+}
+
+// cleanFileName keeps the base name of an uploaded file, without control
+// characters and at most 255 bytes long.
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" || name == "" {
+		name = "file"
+	}
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
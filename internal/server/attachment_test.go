@@ -0,0 +1,35 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "photo.jpg", "photo.jpg"},
+		{"unix path", "../../etc/passwd", "passwd"},
+		{"windows path", `C:\Users\me\report.pdf`, "report.pdf"},
+		{"control characters", "a\x00b\nc\u0085.txt", "abc.txt"},
+		{"empty", "", "file"},
+		{"dot", ".", "file"},
+		{"slash", "/", "file"},
+		{"only control characters", "\r\n", "file"},
+		{"long", strings.Repeat("a", 300), strings.Repeat("a", 255)},
+		{"long multibyte", strings.Repeat("é", 200), strings.Repeat("é", 127)},
+	}
+	for _, tt := range tests {
+		got := cleanFileName(tt.in)
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: %q is not valid UTF-8", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"go.uber.org/zap"
+)
+
+// Maximum sizes, in bytes, of a message's content per type. A card's
+// limit covers its whole encoded body.
+const (
+	maxTextBytes = 16 << 10
+	maxCodeBytes = 64 << 10
+	maxCardBytes = 16 << 10
+	maxCardField = 20
+)
+
+var (
+	ErrInvalidContent = errors.New("invalid content")
+	ErrContentTooLong = errors.New("content too long")
+	ErrNotEditable    = errors.New("message type cannot be edited")
+)
+
+var codeLanguage = regexp.MustCompile(`^[A-Za-z0-9+#._-]{0,32}$`)
+
+// markdown renders CommonMark plus tables and strikethrough. goldmark's
+// default renderer drops raw HTML and unsafe link destinations, so its
+// output is safe to embed.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.Table, extension.Strikethrough, extension.Linkify))
+
+// normalizeContent validates msg's Type and Body as sent by a client and
+// makes Content the plain-text rendering of the message. Plain text is
+// stored with an empty Type so older rows and clients see no change.
+func normalizeContent(msg *model.Message) error {
+	switch msg.Type {
+	case "", model.ContentText, model.ContentMarkdown:
+		if msg.Type == model.ContentText {
+			msg.Type = ""
+		}
+		if len(msg.Body) > 0 {
+			return fmt.Errorf("%w: %s messages have no body", ErrInvalidContent, typeName(msg.Type))
+		}
+		if len(msg.Content) > maxTextBytes {
+			return ErrContentTooLong
+		}
+	case model.ContentCode:
+		var body model.CodeBody
+		if err := decodeBody(msg.Body, &body); err != nil {
+			return err
+		}
+		if body.Code == "" {
+			return fmt.Errorf("%w: code required", ErrInvalidContent)
+		}
+		if len(body.Code) > maxCodeBytes {
+			return ErrContentTooLong
+		}
+		if !codeLanguage.MatchString(body.Language) {
+			return fmt.Errorf("%w: bad language", ErrInvalidContent)
+		}
+		msg.Body, _ = json.Marshal(body)
+		msg.Content = body.Code
+	case model.ContentCard:
+		if len(msg.Body) > maxCardBytes {
+			return ErrContentTooLong
+		}
+		var body model.CardBody
+		if err := decodeBody(msg.Body, &body); err != nil {
+			return err
+		}
+		if body.Title == "" && body.Text == "" {
+			return fmt.Errorf("%w: card needs a title or text", ErrInvalidContent)
+		}
+		if len(body.Fields) > maxCardField {
+			return fmt.Errorf("%w: too many fields", ErrInvalidContent)
+		}
+		for _, u := range []string{body.URL, body.ImageURL} {
+			if u != "" && !webURL(u) {
+				return fmt.Errorf("%w: card links must be http or https", ErrInvalidContent)
+			}
+		}
+		msg.Body, _ = json.Marshal(body)
+		msg.Content = cardText(&body)
+	case model.ContentSystem:
+		return fmt.Errorf("%w: system messages are sent by the server", ErrInvalidContent)
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidContent, msg.Type)
+	}
+	return nil
+}
+
+// postNotice records in roomID, as a system message from userID,
+// something they did there, with text as its plain-text fallback.
+func (s *Server) postNotice(ctx context.Context, roomID, userID string, body model.SystemBody, text string) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		s.log.Error("marshal error", zap.Error(err))
+		return
+	}
+	msg := &model.Message{UserID: userID, RoomID: roomID, Type: model.ContentSystem, Body: b, Content: text}
+	if err := s.postMessage(ctx, msg, nil, nil); err != nil {
+		s.log.Error("failed to post system message", zap.Error(err))
+	}
+}
+
+func decodeBody(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return fmt.Errorf("%w: body required", ErrInvalidContent)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidContent, err)
+	}
+	return nil
+}
+
+func typeName(t model.ContentType) string {
+	if t == "" {
+		return string(model.ContentText)
+	}
+	return string(t)
+}
+
+func webURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// cardText is what clients without card support show instead.
+func cardText(c *model.CardBody) string {
+	var parts []string
+	for _, s := range []string{c.Title, c.Text, c.URL} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	for _, f := range c.Fields {
+		parts = append(parts, f.Name+": "+f.Value)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// RenderHTML fills in the HTML of each markdown message in msgs.
+func (s *Server) RenderHTML(msgs ...*model.Message) {
+	for _, m := range msgs {
+		if m == nil || m.Type != model.ContentMarkdown || m.Deleted {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(m.Content), &buf); err != nil {
+			continue
+		}
+		m.HTML = buf.String()
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+)
+
+func TestNormalizeContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         model.Message
+		wantErr     error
+		wantType    model.ContentType
+		wantContent string
+	}{
+		{"plain", model.Message{Content: "hi"}, nil, "", "hi"},
+		{"text stored as plain", model.Message{Type: model.ContentText, Content: "hi"}, nil, "", "hi"},
+		{"markdown", model.Message{Type: model.ContentMarkdown, Content: "*hi*"}, nil, model.ContentMarkdown, "*hi*"},
+		{"text with body", model.Message{Content: "hi", Body: []byte(`{}`)}, ErrInvalidContent, "", ""},
+		{"text too long", model.Message{Content: strings.Repeat("a", maxTextBytes+1)}, ErrContentTooLong, "", ""},
+		{"code", model.Message{Type: model.ContentCode, Body: []byte(`{"Language":"go","Code":"x := 1"}`)}, nil, model.ContentCode, "x := 1"},
+		{"code without body", model.Message{Type: model.ContentCode}, ErrInvalidContent, "", ""},
+		{"code empty", model.Message{Type: model.ContentCode, Body: []byte(`{"Language":"go"}`)}, ErrInvalidContent, "", ""},
+		{"code bad language", model.Message{Type: model.ContentCode, Body: []byte(`{"Language":"go lang","Code":"x"}`)}, ErrInvalidContent, "", ""},
+		{"code too long", model.Message{Type: model.ContentCode, Body: []byte(`{"Code":"` + strings.Repeat("a", maxCodeBytes+1) + `"}`)}, ErrContentTooLong, "", ""},
+		{"card", model.Message{Type: model.ContentCard, Body: []byte(`{"Title":"T","URL":"https://x.test","Fields":[{"Name":"a","Value":"b"}]}`)}, nil, model.ContentCard, "T\nhttps://x.test\na: b"},
+		{"card untitled", model.Message{Type: model.ContentCard, Body: []byte(`{"URL":"https://x.test"}`)}, ErrInvalidContent, "", ""},
+		{"card script link", model.Message{Type: model.ContentCard, Body: []byte(`{"Title":"T","URL":"javascript:alert(1)"}`)}, ErrInvalidContent, "", ""},
+		{"card bad json", model.Message{Type: model.ContentCard, Body: []byte(`{"Title":`)}, ErrInvalidContent, "", ""},
+		{"system", model.Message{Type: model.ContentSystem, Content: "hi", Body: []byte(`{"Event":"room_renamed"}`)}, ErrInvalidContent, "", ""},
+		{"unknown", model.Message{Type: "poll", Content: "hi"}, ErrInvalidContent, "", ""},
+	}
+	for _, tt := range tests {
+		msg := tt.msg
+		err := normalizeContent(&msg)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if msg.Type != tt.wantType || msg.Content != tt.wantContent {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, msg.Type, msg.Content, tt.wantType, tt.wantContent)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/google/uuid"
+)
+
+// maxConversationMembers caps group conversations, the caller included.
+// Anything bigger should be a room.
+const maxConversationMembers = 9
+
+var ErrInvalidConversation = errors.New("invalid conversation members")
+
+// OpenConversation returns the direct conversation between userID and
+// others, creating it the first time. The same set of people always gets
+// the same conversation. Others may be anyone the auth middleware lets
+// in, token-only users included, but not disabled accounts.
+func (s *Server) OpenConversation(ctx context.Context, userID string, others []string) (*model.Room, error) {
+	seen := map[string]bool{userID: true}
+	members := []string{userID}
+	for _, id := range others {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		members = append(members, id)
+	}
+	if len(members) < 2 || len(members) > maxConversationMembers {
+		return nil, ErrInvalidConversation
+	}
+	if room, err := s.rooms.GetConversation(ctx, members); err == nil {
+		s.noteRoom(room)
+		return room, nil
+	}
+	for _, id := range members[1:] {
+		disabled, err := s.disabled(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if disabled {
+			return nil, ErrInvalidConversation
+		}
+	}
+	sort.Strings(members)
+	room := &model.Room{ID: uuid.NewString(), Members: members, Direct: true}
+	if err := s.rooms.Create(ctx, room); err != nil {
+		// Someone else opened it at the same time.
+		existing, gerr := s.rooms.GetConversation(ctx, members)
+		if gerr != nil {
+			return nil, err
+		}
+		room = existing
+	}
+	s.noteRoom(room)
+	return room, nil
+}
+
+// Conversations lists userID's direct conversations, most recently
+// active first, each with its last message and unread count.
+func (s *Server) Conversations(ctx context.Context, userID string) ([]*model.Conversation, error) {
+	rooms, err := s.rooms.ListByMember(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	convs := []*model.Conversation{}
+	for _, r := range rooms {
+		if !r.Direct {
+			continue
+		}
+		c := &model.Conversation{Room: r}
+		if msgs, err := s.store.ListByRoom(ctx, r.ID, 1); err == nil && len(msgs) > 0 {
+			c.LastMessage = msgs[0]
+		}
+		var seq int64
+		if m, err := s.reads.Get(ctx, userID, r.ID); err == nil {
+			seq = m.Seq
+		}
+		c.Unread, err = s.store.CountAfter(ctx, r.ID, seq, userID)
+		if err != nil {
+			return nil, err
+		}
+		convs = append(convs, c)
+	}
+	sort.SliceStable(convs, func(i, j int) bool {
+		return lastActivity(convs[i]) > lastActivity(convs[j])
+	})
+	return convs, nil
+}
+
+func lastActivity(c *model.Conversation) int64 {
+	if c.LastMessage == nil {
+		return 0
+	}
+	return c.LastMessage.Timestamp
+}
+
+// CanAccess reports whether userID may post to and read roomID. Direct
+// conversations are limited to their members; other rooms, including ad
+// hoc ones that were never created, are open. Deleted rooms, including
+// the tombstones of purged ones, are closed to everyone.
+func (s *Server) CanAccess(ctx context.Context, userID, roomID string) bool {
+	room, err := s.rooms.Get(ctx, roomID)
+	if err != nil {
+		return true
+	}
+	s.noteRoom(room)
+	if room.DeletedAt != 0 {
+		return false
+	}
+	return !room.Direct || room.HasMember(userID)
+}
+
+// noteRoom remembers the members of direct conversations so events in
+// them reach every participant's connections, whichever room those
+// connections are looking at.
+func (s *Server) noteRoom(room *model.Room) {
+	if !room.Direct {
+		return
+	}
+	s.mu.Lock()
+	s.directs[room.ID] = room.Members
+	s.mu.Unlock()
+}
+
+// forgetDirects drops the conversations of userID, whose last connection
+// just closed, that no member is connected to any more. They are noted
+// again the next time someone touches them. The caller must hold s.mu.
+func (s *Server) forgetDirects(userID string) {
+	for roomID, members := range s.directs {
+		mine, online := false, false
+		for _, m := range members {
+			mine = mine || m == userID
+			online = online || len(s.sessions[m]) > 0
+		}
+		if mine && !online {
+			delete(s.directs, roomID)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+)
+
+func TestOpenConversation(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []*model.User{{ID: "local", Name: "local"}, {ID: "banned", Name: "banned"}} {
+		if err := s.users.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.users.SetDisabled(ctx, "banned", true); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		userID  string
+		others  []string
+		wantErr error
+	}{
+		{"local user", "me", []string{"local"}, nil},
+		{"token-only user", "me", []string{"token-only"}, nil},
+		{"token-only group", "token-a", []string{"token-b", "token-c"}, nil},
+		{"disabled user", "me", []string{"banned"}, ErrInvalidConversation},
+		{"disabled in a group", "me", []string{"local", "banned"}, ErrInvalidConversation},
+		{"only the caller", "me", []string{"me"}, ErrInvalidConversation},
+	}
+	for _, tt := range tests {
+		room, err := s.OpenConversation(ctx, tt.userID, tt.others)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (!room.Direct || !room.HasMember(tt.userID) || len(room.Members) != len(tt.others)+1) {
+			t.Errorf("%s: got room %+v", tt.name, room)
+		}
+	}
+}
+
+// TestAccessPathsAgree checks that posting, reacting, marking read,
+// following threads and uploading and fetching files all let in exactly
+// those CanAccess does.
+func TestAccessPathsAgree(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	rooms := []*model.Room{
+		{ID: "named", Name: "named", Members: []string{"owner"}, OwnerID: "owner"},
+		{ID: "dm", Members: []string{"friend", "owner"}, Direct: true},
+		{ID: "gone", Name: "gone", Members: []string{"owner"}, OwnerID: "owner"},
+	}
+	for _, r := range rooms {
+		if err := s.rooms.Create(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs := make(map[string]*model.Message)
+	files := make(map[string]string)
+	for _, roomID := range []string{"adhoc", "named", "dm", "gone"} {
+		a, err := s.Upload(ctx, "owner", roomID, "a.txt", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatalf("%s: upload: %v", roomID, err)
+		}
+		msg := &model.Message{UserID: "owner", RoomID: roomID, Content: "hi"}
+		if err := s.postMessage(ctx, msg, []string{a.ID}, nil); err != nil {
+			t.Fatal(err)
+		}
+		msgs[roomID], files[roomID] = msg, a.ID
+	}
+	if err := s.DeleteRoom(ctx, "owner", "gone", false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		roomID string
+		userID string
+		want   bool
+	}{
+		{"adhoc", "stranger", true},
+		{"named", "owner", true},
+		{"named", "stranger", true},
+		{"dm", "friend", true},
+		{"dm", "stranger", false},
+		{"gone", "owner", false},
+	}
+	for _, tt := range tests {
+		if got := s.CanAccess(ctx, tt.userID, tt.roomID); got != tt.want {
+			t.Errorf("%s as %s: CanAccess got %v, want %v", tt.roomID, tt.userID, got, tt.want)
+		}
+		msg := msgs[tt.roomID]
+		_, reactErr := s.reactable(ctx, tt.userID, msg.ID, "👍")
+		_, readErr := s.MarkRead(ctx, tt.userID, tt.roomID, msg.ID)
+		_, uploadErr := s.Upload(ctx, tt.userID, tt.roomID, "b.txt", strings.NewReader("hello"))
+		_, rc, openErr := s.OpenAttachment(ctx, tt.userID, files[tt.roomID], false)
+		if rc != nil {
+			rc.Close()
+		}
+		paths := map[string]error{
+			"post":   s.checkMessage(ctx, &model.Message{UserID: tt.userID, RoomID: tt.roomID, Content: "hi"}, 0),
+			"reply":  s.checkMessage(ctx, &model.Message{UserID: tt.userID, RoomID: tt.roomID, Content: "re", ParentID: msg.ID}, 0),
+			"react":  reactErr,
+			"read":   readErr,
+			"follow": s.subscribeThread(ctx, nil, tt.userID, msg.ID),
+			"upload": uploadErr,
+			"open":   openErr,
+		}
+		for path, err := range paths {
+			if got := err == nil; got != tt.want {
+				t.Errorf("%s as %s: %s allowed %v, want %v (%v)", tt.roomID, tt.userID, path, got, tt.want, err)
+			}
+		}
+	}
+}
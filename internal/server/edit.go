@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrForbidden      = errors.New("not allowed")
+	ErrMessageDeleted = errors.New("message deleted")
+	ErrEmptyContent   = errors.New("content required")
+)
+
+// EditMessage replaces the content of messageID on behalf of userID and
+// tells the room with a message_edited event. Only text and markdown
+// messages can be edited.
+func (s *Server) EditMessage(ctx context.Context, userID, messageID, content string) (*model.Message, error) {
+	if content == "" {
+		return nil, ErrEmptyContent
+	}
+	if len(content) > maxTextBytes {
+		return nil, ErrContentTooLong
+	}
+	msg, err := s.editableMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != "" && msg.Type != model.ContentMarkdown {
+		return nil, ErrNotEditable
+	}
+	now := time.Now().Unix()
+	if err := s.store.Update(ctx, msg.ID, content, userID, now); err != nil {
+		return nil, ErrMessageDeleted
+	}
+	msg.Content = content
+	msg.EditedAt = now
+	if err := s.search.Index(ctx, msg); err != nil {
+		s.log.Error("failed to index message", zap.Error(err))
+	}
+	s.publishRevision("message_edited", userID, msg, now)
+	s.notifyMentions(ctx, msg)
+	return msg, nil
+}
+
+// DeleteMessage turns messageID into a tombstone on behalf of userID and
+// tells the room with a message_deleted event.
+func (s *Server) DeleteMessage(ctx context.Context, userID, messageID string) (*model.Message, error) {
+	msg, err := s.editableMessage(ctx, userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if err := s.store.Delete(ctx, msg.ID, userID, now); err != nil {
+		return nil, ErrMessageDeleted
+	}
+	msg.Content = ""
+	msg.Body = nil
+	msg.Deleted = true
+	if err := s.search.Remove(ctx, msg.ID); err != nil {
+		s.log.Error("failed to unindex message", zap.Error(err))
+	}
+	s.publishRevision("message_deleted", userID, msg, now)
+	s.dropPin(ctx, msg, userID, now)
+	return msg, nil
+}
+
+// CanModerate reports whether userID may change or remove messages in
+// roomID that they did not write: global admins and the room's owner can.
+func (s *Server) CanModerate(ctx context.Context, userID, roomID string) bool {
+	if s.IsAdmin(userID) {
+		return true
+	}
+	room, err := s.rooms.Get(ctx, roomID)
+	return err == nil && room.OwnerID != "" && room.OwnerID == userID
+}
+
+func (s *Server) editableMessage(ctx context.Context, userID, messageID string) (*model.Message, error) {
+	msg, err := s.store.Get(ctx, messageID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+	if !s.CanAccess(ctx, userID, msg.RoomID) {
+		return nil, ErrMessageNotFound
+	}
+	if msg.UserID != userID && !s.CanModerate(ctx, userID, msg.RoomID) {
+		return nil, ErrForbidden
+	}
+	if msg.Deleted {
+		return nil, ErrMessageDeleted
+	}
+	if err := s.checkOpen(ctx, msg.RoomID); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Server) publishRevision(event, userID string, msg *model.Message, at int64) {
+	s.broadcastThreadEvent(msg.RoomID, threadOf(msg), model.Event{
+		Event:     event,
+		RoomID:    msg.RoomID,
+		UserID:    userID,
+		Data:      msg,
+		Timestamp: at,
+	})
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidTTL = errors.New("invalid ttl")
+
+// expireBatch is how many ephemeral messages one pass of the expiry loop
+// removes at most.
+const expireBatch = 200
+
+// checkTTL validates an ephemeral message's TTL and mode; a TTL without
+// a mode expires after send.
+func (s *Server) checkTTL(msg *model.Message) error {
+	if msg.TTL == 0 {
+		if msg.ExpireMode != "" {
+			return ErrInvalidTTL
+		}
+		return nil
+	}
+	if msg.TTL < 0 || (s.cfg.MaxMessageTTL > 0 && msg.TTL > int64(s.cfg.MaxMessageTTL/time.Second)) {
+		return ErrInvalidTTL
+	}
+	switch msg.ExpireMode {
+	case "":
+		msg.ExpireMode = model.ExpireOnSend
+	case model.ExpireOnSend, model.ExpireOnRead:
+	default:
+		return ErrInvalidTTL
+	}
+	return nil
+}
+
+func (s *Server) expiryLoop() {
+	if s.cfg.ExpireEvery <= 0 {
+		return
+	}
+	t := time.NewTicker(s.cfg.ExpireEvery)
+	defer t.Stop()
+	for range t.C {
+		s.expireMessages(context.Background())
+	}
+}
+
+// expireMessages removes ephemeral messages whose time is up and tells
+// their rooms with a message_deleted event, as if they had been deleted.
+// In a room under legal hold they are only soft-deleted, so their content
+// is kept.
+func (s *Server) expireMessages(ctx context.Context) {
+	for {
+		now := time.Now().Unix()
+		msgs, err := s.store.ListExpired(ctx, now, expireBatch)
+		if err != nil {
+			s.log.Error("failed to list expired messages", zap.Error(err))
+			return
+		}
+		if len(msgs) == 0 {
+			return
+		}
+		held := make(map[string]bool)
+		var gone, kept []string
+		for _, m := range msgs {
+			h, ok := held[m.RoomID]
+			if !ok {
+				if h, err = s.onHold(ctx, m.RoomID); err != nil {
+					s.log.Error("failed to check legal hold", zap.Error(err))
+					return
+				}
+				held[m.RoomID] = h
+			}
+			if h {
+				kept = append(kept, m.ID)
+			} else {
+				gone = append(gone, m.ID)
+			}
+		}
+		if len(gone) > 0 {
+			if err := s.removeMessages(ctx, gone); err != nil {
+				s.log.Error("failed to remove expired messages", zap.Error(err))
+				return
+			}
+		}
+		if err := s.store.Retire(ctx, kept, now); err != nil {
+			s.log.Error("failed to retire expired messages", zap.Error(err))
+			return
+		}
+		for _, id := range kept {
+			if err := s.search.Remove(ctx, id); err != nil {
+				s.log.Error("failed to unindex message", zap.Error(err))
+			}
+		}
+		for _, m := range msgs {
+			m.Content = ""
+			m.Body = nil
+			m.Deleted = true
+			s.publishRevision("message_deleted", "", m, now)
+		}
+		if len(msgs) < expireBatch {
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/config"
+	"github.com/1cbyc/go-websocket-server/internal/model"
+)
+
+func TestCheckTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      time.Duration
+		ttl      int64
+		mode     model.ExpireMode
+		wantErr  error
+		wantMode model.ExpireMode
+	}{
+		{"no ttl", time.Hour, 0, "", nil, ""},
+		{"mode without ttl", time.Hour, 0, model.ExpireOnRead, ErrInvalidTTL, ""},
+		{"defaults to send", time.Hour, 60, "", nil, model.ExpireOnSend},
+		{"on read", time.Hour, 60, model.ExpireOnRead, nil, model.ExpireOnRead},
+		{"unknown mode", time.Hour, 60, "later", ErrInvalidTTL, ""},
+		{"negative", time.Hour, -1, "", ErrInvalidTTL, ""},
+		{"at the cap", time.Hour, 3600, "", nil, model.ExpireOnSend},
+		{"over the cap", time.Hour, 3601, "", ErrInvalidTTL, ""},
+		{"no cap", 0, 1 << 40, "", nil, model.ExpireOnSend},
+	}
+	for _, tt := range tests {
+		s := &Server{cfg: &config.Config{MaxMessageTTL: tt.max}}
+		msg := &model.Message{TTL: tt.ttl, ExpireMode: tt.mode}
+		err := s.checkTTL(msg)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && msg.ExpireMode != tt.wantMode {
+			t.Errorf("%s: got mode %q, want %q", tt.name, msg.ExpireMode, tt.wantMode)
+		}
+	}
+}
+
+func TestExpireMessagesUnderLegalHold(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	if err := s.rooms.Create(ctx, &model.Room{ID: "held", Name: "held", Members: []string{"u"}, OwnerID: "u"}); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Unix() - 10
+	for _, roomID := range []string{"held", "free"} {
+		msg := &model.Message{ID: roomID, UserID: "u", RoomID: roomID, Content: "secret", Timestamp: past, TTL: 1, ExpireMode: model.ExpireOnSend, ExpiresAt: past + 1}
+		if err := s.store.Save(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetRetention(ctx, "admin", &model.RetentionPolicy{RoomID: "held", LegalHold: true}); err != nil {
+		t.Fatal(err)
+	}
+	s.expireMessages(ctx)
+	tests := []struct {
+		id       string
+		wantKept bool
+	}{
+		{"held", true},
+		{"free", false},
+	}
+	for _, tt := range tests {
+		msg, err := s.store.Get(ctx, tt.id)
+		if kept := err == nil; kept != tt.wantKept {
+			t.Errorf("%s: kept %v, want %v", tt.id, kept, tt.wantKept)
+			continue
+		}
+		revs, err := s.store.ListRevisions(ctx, tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tt.wantKept {
+			if len(revs) != 0 {
+				t.Errorf("%s: revisions left behind", tt.id)
+			}
+			continue
+		}
+		if !msg.Deleted || msg.Content != "" {
+			t.Errorf("%s: got %+v, want it deleted", tt.id, msg)
+		}
+		if len(revs) != 1 || revs[0].Content != "secret" {
+			t.Errorf("%s: got revisions %+v, want the content kept", tt.id, revs)
+		}
+	}
+	if msgs, err := s.store.ListExpired(ctx, time.Now().Unix(), 10); err != nil || len(msgs) != 0 {
+		t.Errorf("still expired: %v, %v", msgs, err)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// maxMentions caps how many distinct names one message can call out.
+const maxMentions = 20
+
+// mentionPattern matches @name where name follows the account name rules.
+// The @ must not follow a name character, so e-mail addresses are not
+// mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.@-])@([A-Za-z0-9_.-]{3,32})`)
+
+// parseMentions picks the mentions out of content. @room and @here are
+// reserved and reported separately from names.
+func parseMentions(content string) (names []string, room, here bool) {
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(m[1])
+		switch name {
+		case "room":
+			room = true
+		case "here":
+			here = true
+		default:
+			if !seen[name] && len(names) < maxMentions {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, room, here
+}
+
+// notifyMentions records who msg mentions and sends each of them a
+// mention event on all of their connections. Only members of an existing
+// room can be mentioned in it. Running it again after an edit only
+// notifies people who were not mentioned before. Code snippets mention
+// nobody.
+func (s *Server) notifyMentions(ctx context.Context, msg *model.Message) {
+	if msg.Type == model.ContentCode || msg.Type == model.ContentSystem {
+		return
+	}
+	names, all, here := parseMentions(msg.Content)
+	if len(names) == 0 && !all && !here {
+		return
+	}
+	var members []string
+	room, err := s.rooms.Get(ctx, msg.RoomID)
+	if err == nil {
+		members = room.Members
+	}
+	kinds := make(map[string]model.MentionKind)
+	for _, name := range names {
+		u, err := s.users.GetByName(ctx, name)
+		if err != nil {
+			if u, err = s.users.GetByName(ctx, strings.TrimRight(name, ".-")); err != nil {
+				continue
+			}
+		}
+		if room == nil || room.HasMember(u.ID) {
+			kinds[u.ID] = model.MentionUser
+		}
+	}
+	for _, id := range members {
+		if _, ok := kinds[id]; ok {
+			continue
+		}
+		switch {
+		case all:
+			kinds[id] = model.MentionRoom
+		case here && s.isHere(ctx, id):
+			kinds[id] = model.MentionHere
+		}
+	}
+	delete(kinds, msg.UserID)
+	for id, kind := range kinds {
+		m := &model.Mention{
+			MessageID: msg.ID,
+			RoomID:    msg.RoomID,
+			UserID:    id,
+			AuthorID:  msg.UserID,
+			Kind:      kind,
+			Timestamp: msg.Timestamp,
+		}
+		added, err := s.mentions.Add(ctx, m)
+		if err != nil {
+			s.log.Error("failed to save mention", zap.Error(err))
+			continue
+		}
+		if !added {
+			continue
+		}
+		m.Message = msg
+		s.SendToUser(id, model.Event{
+			Event:     "mention",
+			RoomID:    msg.RoomID,
+			UserID:    msg.UserID,
+			Data:      m,
+			Timestamp: msg.Timestamp,
+		})
+	}
+}
+
+// isHere reports whether userID is connected and has not asked to look
+// offline, which is who @here reaches.
+func (s *Server) isHere(ctx context.Context, userID string) bool {
+	s.mu.Lock()
+	_, online := s.sessions[userID]
+	s.mu.Unlock()
+	return online && s.visiblePresence(ctx, userID).Online
+}
+
+// Mentions lists userID's latest mentions with their messages, leaving
+// out any in conversations they can no longer access.
+func (s *Server) Mentions(ctx context.Context, userID string, limit int) ([]*model.Mention, error) {
+	ms, err := s.mentions.ListByUser(ctx, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*model.Mention, 0, len(ms))
+	for _, m := range ms {
+		if !s.CanAccess(ctx, userID, m.RoomID) {
+			continue
+		}
+		if msg, err := s.store.Get(ctx, m.MessageID); err == nil {
+			m.Message = msg
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// SendToUser sends ev to every connection userID has open.
+func (s *Server) SendToUser(userID string, ev model.Event) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		s.log.Error("marshal error", zap.Error(err))
+		return
+	}
+	s.mu.Lock()
+	targets := make(map[*websocket.Conn]bool, len(s.sessions[userID]))
+	for ws := range s.sessions[userID] {
+		targets[ws] = true
+	}
+	s.mu.Unlock()
+	s.deliver(targets, b)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	var many []string
+	for i := 0; i < maxMentions+5; i++ {
+		many = append(many, fmt.Sprintf("@user%02d", i))
+	}
+	tests := []struct {
+		name      string
+		content   string
+		wantNames []string
+		wantRoom  bool
+		wantHere  bool
+	}{
+		{"none", "hello there", nil, false, false},
+		{"one", "hi @alice", []string{"alice"}, false, false},
+		{"start of text", "@alice hi", []string{"alice"}, false, false},
+		{"lower cased and deduplicated", "@Alice and @alice and @bob", []string{"alice", "bob"}, false, false},
+		{"punctuation around", "(@alice), @bob!", []string{"alice", "bob"}, false, false},
+		{"email is not a mention", "mail bob@example.com", nil, false, false},
+		{"double at", "@@alice", nil, false, false},
+		{"too short", "@al", nil, false, false},
+		{"room and here", "@room @here", nil, true, true},
+		{"room with names", "@here @carol", []string{"carol"}, false, true},
+		{"capped", strings.Join(many, " "), mentionNames(many[:maxMentions]), false, false},
+	}
+	for _, tt := range tests {
+		names, room, here := parseMentions(tt.content)
+		if !reflect.DeepEqual(names, tt.wantNames) || room != tt.wantRoom || here != tt.wantHere {
+			t.Errorf("%s: got %v %v %v, want %v %v %v", tt.name, names, room, here, tt.wantNames, tt.wantRoom, tt.wantHere)
+		}
+	}
+}
+
+func mentionNames(mentions []string) []string {
+	names := make([]string, len(mentions))
+	for i, m := range mentions {
+		names[i] = strings.TrimPrefix(m, "@")
+	}
+	return names
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+)
+
+var ErrTooManyPins = errors.New("too many pinned messages")
+
+const maxPins = 50
+
+// PinMessage pins messageID in roomID on behalf of userID and tells the
+// room with a message_pinned event and a system message. Pinning twice
+// changes nothing.
+func (s *Server) PinMessage(ctx context.Context, userID, roomID, messageID string) (*model.Pin, error) {
+	room, msg, err := s.pinnable(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.pins.CountByRoom(ctx, room.ID)
+	if err != nil {
+		return nil, err
+	}
+	if n >= maxPins {
+		return nil, ErrTooManyPins
+	}
+	p := &model.Pin{MessageID: msg.ID, RoomID: room.ID, PinnedBy: userID, PinnedAt: time.Now().Unix()}
+	added, err := s.pins.Add(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if added {
+		s.BroadcastEvent(room.ID, "", model.Event{
+			Event:     "message_pinned",
+			RoomID:    room.ID,
+			UserID:    userID,
+			Data:      p,
+			Timestamp: p.PinnedAt,
+		})
+		s.postNotice(ctx, room.ID, userID, model.SystemBody{Event: "message_pinned", MessageID: msg.ID}, "pinned a message")
+	}
+	return p, nil
+}
+
+// UnpinMessage removes messageID from roomID's pins and tells the room
+// with a message_unpinned event and a system message.
+func (s *Server) UnpinMessage(ctx context.Context, userID, roomID, messageID string) error {
+	room, err := s.visibleRoom(ctx, userID, roomID)
+	if err != nil {
+		return err
+	}
+	if !s.canManage(ctx, userID, room) {
+		return ErrForbidden
+	}
+	if room.Archived {
+		return ErrRoomArchived
+	}
+	removed, err := s.pins.Remove(ctx, room.ID, messageID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrMessageNotFound
+	}
+	now := time.Now().Unix()
+	s.BroadcastEvent(room.ID, "", model.Event{
+		Event:     "message_unpinned",
+		RoomID:    room.ID,
+		UserID:    userID,
+		Data:      &model.Pin{MessageID: messageID, RoomID: room.ID, PinnedBy: userID, PinnedAt: now},
+		Timestamp: now,
+	})
+	s.postNotice(ctx, room.ID, userID, model.SystemBody{Event: "message_unpinned", MessageID: messageID}, "unpinned a message")
+	return nil
+}
+
+// Pins lists roomID's pinned messages, newest pin first. Pins of messages
+// that were deleted since are left out.
+func (s *Server) Pins(ctx context.Context, userID, roomID string) ([]*model.Pin, error) {
+	room, err := s.visibleRoom(ctx, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	all, err := s.pins.ListByRoom(ctx, room.ID)
+	if err != nil {
+		return nil, err
+	}
+	pins := []*model.Pin{}
+	var msgs []*model.Message
+	for _, p := range all {
+		msg, err := s.store.Get(ctx, p.MessageID)
+		if err != nil || msg.Deleted {
+			continue
+		}
+		p.Message = msg
+		pins = append(pins, p)
+		msgs = append(msgs, msg)
+	}
+	s.FillMessages(ctx, msgs...)
+	return pins, nil
+}
+
+// dropPin unpins msg, which userID just deleted, telling the room with a
+// message_unpinned event if it was pinned.
+func (s *Server) dropPin(ctx context.Context, msg *model.Message, userID string, now int64) {
+	removed, err := s.pins.Remove(ctx, msg.RoomID, msg.ID)
+	if err != nil {
+		s.log.Error("failed to unpin deleted message", zap.Error(err))
+		return
+	}
+	if removed {
+		s.BroadcastEvent(msg.RoomID, "", model.Event{
+			Event:     "message_unpinned",
+			RoomID:    msg.RoomID,
+			UserID:    userID,
+			Data:      &model.Pin{MessageID: msg.ID, RoomID: msg.RoomID, PinnedBy: userID, PinnedAt: now},
+			Timestamp: now,
+		})
+	}
+}
+
+func (s *Server) pinnable(ctx context.Context, userID, roomID, messageID string) (*model.Room, *model.Message, error) {
+	room, err := s.visibleRoom(ctx, userID, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !s.canManage(ctx, userID, room) {
+		return nil, nil, ErrForbidden
+	}
+	if room.Archived {
+		return nil, nil, ErrRoomArchived
+	}
+	msg, err := s.store.Get(ctx, messageID)
+	if err != nil || msg.RoomID != room.ID {
+		return nil, nil, ErrMessageNotFound
+	}
+	if msg.Deleted {
+		return nil, nil, ErrMessageDeleted
+	}
+	return room, msg, nil
+}
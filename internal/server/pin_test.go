@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+)
+
+func TestPinsOfDeletedMessages(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	if err := s.rooms.Create(ctx, &model.Room{ID: "r", Name: "r", Members: []string{"owner"}, OwnerID: "owner"}); err != nil {
+		t.Fatal(err)
+	}
+	post := func() *model.Message {
+		msg := &model.Message{UserID: "owner", RoomID: "r", Content: "hi"}
+		if err := s.postMessage(ctx, msg, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	var pinned []*model.Message
+	for i := 0; i < maxPins; i++ {
+		msg := post()
+		if _, err := s.PinMessage(ctx, "owner", "r", msg.ID); err != nil {
+			t.Fatalf("pin %d: %v", i, err)
+		}
+		pinned = append(pinned, msg)
+	}
+	if _, err := s.PinMessage(ctx, "owner", "r", post().ID); !errors.Is(err, ErrTooManyPins) {
+		t.Fatalf("pin over the cap: got %v, want %v", err, ErrTooManyPins)
+	}
+	for _, msg := range pinned[:2] {
+		if _, err := s.DeleteMessage(ctx, "owner", msg.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pins, err := s.Pins(ctx, "owner", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != maxPins-2 {
+		t.Errorf("got %d pins, want %d", len(pins), maxPins-2)
+	}
+	if n, err := s.pins.CountByRoom(ctx, "r"); err != nil || n != maxPins-2 {
+		t.Errorf("count: got %d, %v; want %d", n, err, maxPins-2)
+	}
+	if _, err := s.PinMessage(ctx, "owner", "r", post().ID); err != nil {
+		t.Errorf("pin after deleting pinned messages: %v", err)
+	}
+}
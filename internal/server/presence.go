@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+var ErrInvalidStatus = errors.New("invalid status")
+
+const (
+	maxStatusText  = 128
+	maxStatusEmoji = 16
+)
+
+// SetStatus records the status a user picked for themselves. A ttl in
+// seconds makes the status and its text revert to online once it passes.
+func (s *Server) SetStatus(ctx context.Context, userID string, status model.PresenceStatus, text, emoji string, ttl int64) error {
+	switch status {
+	case model.StatusOnline, model.StatusAway, model.StatusBusy, model.StatusInvisible:
+	default:
+		return ErrInvalidStatus
+	}
+	if len(text) > maxStatusText || len(emoji) > maxStatusEmoji || ttl < 0 {
+		return ErrInvalidStatus
+	}
+	p := &model.Presence{
+		UserID:      userID,
+		Status:      status,
+		StatusText:  text,
+		StatusEmoji: emoji,
+	}
+	if ttl > 0 {
+		p.StatusExpiresAt = time.Now().Unix() + ttl
+	}
+	if err := s.presence.SetStatus(ctx, p); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.autoAway, userID)
+	s.mu.Unlock()
+	s.publishPresence(userID)
+	return nil
+}
+
+// touch records activity from userID and reports whether they had been
+// marked idle and need their automatic away status cleared.
+func (s *Server) touch(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activity[userID] = time.Now()
+	away, idle := s.autoAway[userID]
+	delete(s.autoAway, userID)
+	return idle && away
+}
+
+// clearAutoAway puts a user back online if the server, not the user, set
+// them away.
+func (s *Server) clearAutoAway(userID string) {
+	ctx := context.Background()
+	p, err := s.presence.Get(ctx, userID)
+	if err != nil || !p.AutoAway {
+		return
+	}
+	p.Status = model.StatusOnline
+	p.AutoAway = false
+	if err := s.presence.SetStatus(ctx, p); err != nil {
+		s.log.Error("failed to clear away status", zap.Error(err))
+		return
+	}
+	s.publishPresence(userID)
+}
+
+func (s *Server) presenceLoop() {
+	tick := 30 * time.Second
+	if a := s.cfg.AwayAfter / 2; a > 0 && a < tick {
+		tick = a
+	}
+	if tick < time.Second {
+		tick = time.Second
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for range t.C {
+		s.markIdleAway()
+		s.expireStatuses()
+	}
+}
+
+// markIdleAway switches connected users who have sent nothing for
+// AwayAfter from online to away.
+func (s *Server) markIdleAway() {
+	if s.cfg.AwayAfter <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-s.cfg.AwayAfter)
+	var idle []string
+	s.mu.Lock()
+	for userID := range s.sessions {
+		if _, done := s.autoAway[userID]; !done && s.activity[userID].Before(cutoff) {
+			idle = append(idle, userID)
+		}
+	}
+	s.mu.Unlock()
+	ctx := context.Background()
+	for _, userID := range idle {
+		p, err := s.presence.Get(ctx, userID)
+		away := err == nil && p.Status == model.StatusOnline
+		if away {
+			p.Status = model.StatusAway
+			p.AutoAway = true
+			if err := s.presence.SetStatus(ctx, p); err != nil {
+				s.log.Error("failed to set away status", zap.Error(err))
+				continue
+			}
+			s.publishPresence(userID)
+		}
+		s.mu.Lock()
+		if _, ok := s.sessions[userID]; ok {
+			s.autoAway[userID] = away
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) expireStatuses() {
+	ids, err := s.presence.ExpireStatuses(context.Background(), time.Now().Unix())
+	if err != nil {
+		s.log.Error("failed to expire statuses", zap.Error(err))
+		return
+	}
+	for _, userID := range ids {
+		s.publishPresence(userID)
+	}
+}
+
+const maxPresenceSubs = 200
+
+// visiblePresence is what other users may see of userID: invisible users
+// appear offline.
+func (s *Server) visiblePresence(ctx context.Context, userID string) *model.Presence {
+	p, err := s.presence.Get(ctx, userID)
+	if err != nil {
+		return &model.Presence{UserID: userID, Status: model.StatusOffline}
+	}
+	if p.Status == model.StatusInvisible {
+		return &model.Presence{UserID: userID, Status: model.StatusOffline, LastSeen: p.LastSeen}
+	}
+	return p
+}
+
+// publishPresence sends userID's current presence to everyone sharing a
+// room with them and to connections that subscribed to them.
+func (s *Server) publishPresence(userID string) {
+	ctx := context.Background()
+	b, err := json.Marshal(model.Event{
+		Event:     "presence",
+		UserID:    userID,
+		Data:      s.visiblePresence(ctx, userID),
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		s.log.Error("marshal error", zap.Error(err))
+		return
+	}
+	peers := make(map[string]bool)
+	rooms, err := s.rooms.ListByMember(ctx, userID)
+	if err != nil {
+		s.log.Error("failed to list rooms for presence", zap.Error(err))
+	}
+	for _, r := range rooms {
+		for _, m := range r.Members {
+			peers[m] = true
+		}
+	}
+	delete(peers, userID)
+	targets := make(map[*websocket.Conn]bool)
+	s.mu.Lock()
+	for peer := range peers {
+		for ws := range s.sessions[peer] {
+			targets[ws] = true
+		}
+	}
+	for ws, subs := range s.presSubs {
+		if subs[userID] {
+			targets[ws] = true
+		}
+	}
+	s.mu.Unlock()
+	s.deliver(targets, b)
+}
+
+// scheduleOffline announces that userID went offline once the debounce
+// window passes without them reconnecting.
+func (s *Server) scheduleOffline(userID string) {
+	if s.cfg.PresenceDebounce <= 0 {
+		s.publishPresence(userID)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.offline[userID]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(s.cfg.PresenceDebounce, func() {
+		s.mu.Lock()
+		if s.offline[userID] != t {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.offline, userID)
+		_, online := s.sessions[userID]
+		s.mu.Unlock()
+		if !online {
+			s.publishPresence(userID)
+		}
+	})
+	s.offline[userID] = t
+}
+
+// cancelOffline stops a pending offline announcement and reports whether
+// there was one, in which case peers never saw the user leave.
+func (s *Server) cancelOffline(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.offline[userID]
+	if ok {
+		t.Stop()
+		delete(s.offline, userID)
+	}
+	return ok
+}
+
+func (s *Server) subscribePresence(ws *websocket.Conn, userIDs []string) {
+	s.mu.Lock()
+	subs, ok := s.presSubs[ws]
+	if !ok {
+		subs = make(map[string]bool)
+		s.presSubs[ws] = subs
+	}
+	var added []string
+	for _, id := range userIDs {
+		if len(subs) >= maxPresenceSubs {
+			break
+		}
+		if id != "" && !subs[id] {
+			subs[id] = true
+			added = append(added, id)
+		}
+	}
+	s.mu.Unlock()
+	ctx := context.Background()
+	for _, id := range added {
+		s.send(ws, model.Event{
+			Event:     "presence",
+			UserID:    id,
+			Data:      s.visiblePresence(ctx, id),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+}
+
+func (s *Server) unsubscribePresence(ws *websocket.Conn, userIDs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := s.presSubs[ws]
+	for _, id := range userIDs {
+		delete(subs, id)
+	}
+}
+
+// recoverPresence runs at startup, before any connection is accepted.
+// Anyone still marked online through this instance (or by a version that
+// did not record instances) is left over from a crash, so they are marked
+// offline as of our last heartbeat.
+func (s *Server) recoverPresence() {
+	ctx := context.Background()
+	lastSeen, err := s.presence.GetHeartbeat(ctx, s.cfg.InstanceID)
+	if err != nil {
+		lastSeen = 0
+	}
+	for _, id := range []string{s.cfg.InstanceID, ""} {
+		ids, err := s.presence.MarkInstanceOffline(ctx, id, lastSeen)
+		if err != nil {
+			s.log.Error("failed to recover presence", zap.Error(err))
+			continue
+		}
+		if len(ids) > 0 {
+			s.log.Info("marked stale presence offline", zap.String("instance", id), zap.Int("users", len(ids)))
+		}
+	}
+	if err := s.presence.Heartbeat(ctx, s.cfg.InstanceID, time.Now().Unix()); err != nil {
+		s.log.Error("failed to record heartbeat", zap.Error(err))
+	}
+}
+
+func (s *Server) reconcileLoop() {
+	if s.cfg.ReconcileEvery <= 0 {
+		return
+	}
+	t := time.NewTicker(s.cfg.ReconcileEvery)
+	defer t.Stop()
+	for range t.C {
+		s.reconcilePresence()
+	}
+}
+
+// reconcilePresence makes the presence table agree with our live
+// connections and cleans up after other instances that stopped sending
+// heartbeats.
+func (s *Server) reconcilePresence() {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	if err := s.presence.Heartbeat(ctx, s.cfg.InstanceID, now); err != nil {
+		s.log.Error("failed to record heartbeat", zap.Error(err))
+	}
+	stored, err := s.presence.ListOnlineByInstance(ctx, s.cfg.InstanceID)
+	if err != nil {
+		s.log.Error("failed to list presence", zap.Error(err))
+		return
+	}
+	online := make(map[string]bool, len(stored))
+	for _, id := range stored {
+		online[id] = true
+	}
+	var ghosts, missing []string
+	s.mu.Lock()
+	for _, id := range stored {
+		if _, ok := s.sessions[id]; !ok {
+			ghosts = append(ghosts, id)
+		}
+	}
+	for id := range s.sessions {
+		if !online[id] {
+			missing = append(missing, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range ghosts {
+		s.presence.SetOnline(ctx, id, s.cfg.InstanceID, false, now)
+		s.publishPresence(id)
+	}
+	for _, id := range missing {
+		s.presence.SetOnline(ctx, id, s.cfg.InstanceID, true, now)
+		s.publishPresence(id)
+	}
+	if s.cfg.InstanceTimeout <= 0 {
+		return
+	}
+	stale, err := s.presence.StaleInstances(ctx, now-int64(s.cfg.InstanceTimeout.Seconds()))
+	if err != nil {
+		s.log.Error("failed to list stale instances", zap.Error(err))
+		return
+	}
+	for id, heartbeat := range stale {
+		if id == s.cfg.InstanceID {
+			continue
+		}
+		ids, err := s.presence.MarkInstanceOffline(ctx, id, heartbeat)
+		if err != nil {
+			s.log.Error("failed to clear stale instance", zap.String("instance", id), zap.Error(err))
+			continue
+		}
+		s.presence.RemoveInstance(ctx, id)
+		s.log.Info("cleared stale instance", zap.String("instance", id), zap.Int("users", len(ids)))
+		for _, userID := range ids {
+			s.publishPresence(userID)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/ratelimit"
+	"golang.org/x/net/websocket"
+)
+
+// maxEmojiLen bounds a reaction in bytes; it is generous enough for
+// multi-codepoint emoji and short :shortcodes:.
+const maxEmojiLen = 64
+
+var ErrInvalidEmoji = errors.New("invalid emoji")
+
+func (s *Server) handleReaction(ws *websocket.Conn, userID string, add bool, messageID, emoji string) {
+	if ok, wait := s.msgLimit.Allow(userID + "|react"); !ok {
+		s.sendError(ws, "rate_limited", "too many reactions", ratelimit.RetryAfter(wait))
+		return
+	}
+	var err error
+	if add {
+		err = s.AddReaction(context.Background(), userID, messageID, emoji)
+	} else {
+		err = s.RemoveReaction(context.Background(), userID, messageID, emoji)
+	}
+	if err != nil {
+		s.sendError(ws, "invalid_reaction", err.Error(), 0)
+	}
+}
+
+// AddReaction records userID reacting to messageID with emoji and tells
+// the room with a reaction_added event. Reacting twice is a no-op.
+func (s *Server) AddReaction(ctx context.Context, userID, messageID, emoji string) error {
+	msg, err := s.reactable(ctx, userID, messageID, emoji)
+	if err != nil {
+		return err
+	}
+	r := &model.Reaction{MessageID: msg.ID, RoomID: msg.RoomID, UserID: userID, Emoji: emoji, CreatedAt: time.Now().Unix()}
+	added, err := s.reactions.Add(ctx, r)
+	if err != nil {
+		return err
+	}
+	if added {
+		s.publishReaction("reaction_added", msg, r)
+	}
+	return nil
+}
+
+// RemoveReaction takes back userID's emoji reaction to messageID and tells
+// the room with a reaction_removed event.
+func (s *Server) RemoveReaction(ctx context.Context, userID, messageID, emoji string) error {
+	msg, err := s.reactable(ctx, userID, messageID, emoji)
+	if err != nil {
+		return err
+	}
+	removed, err := s.reactions.Remove(ctx, msg.ID, userID, emoji)
+	if err != nil {
+		return err
+	}
+	if removed {
+		s.publishReaction("reaction_removed", msg, &model.Reaction{MessageID: msg.ID, RoomID: msg.RoomID, UserID: userID, Emoji: emoji, CreatedAt: time.Now().Unix()})
+	}
+	return nil
+}
+
+func (s *Server) reactable(ctx context.Context, userID, messageID, emoji string) (*model.Message, error) {
+	if emoji == "" || len(emoji) > maxEmojiLen || !utf8.ValidString(emoji) || strings.ContainsAny(emoji, " \t\r\n") {
+		return nil, ErrInvalidEmoji
+	}
+	msg, err := s.store.Get(ctx, messageID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+	if !s.CanAccess(ctx, userID, msg.RoomID) {
+		return nil, ErrMessageNotFound
+	}
+	if msg.Deleted {
+		return nil, ErrMessageDeleted
+	}
+	if err := s.checkOpen(ctx, msg.RoomID); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Server) publishReaction(event string, msg *model.Message, r *model.Reaction) {
+	s.broadcastThreadEvent(msg.RoomID, threadOf(msg), model.Event{
+		Event:     event,
+		RoomID:    msg.RoomID,
+		UserID:    r.UserID,
+		Data:      r,
+		Timestamp: r.CreatedAt,
+	})
+}
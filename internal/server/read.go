@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// MarkRead advances userID's read marker in roomID to messageID and, if
+// it moved, tells the room with a read_receipt event. Only those who may
+// read the room, as CanAccess decides, keep read markers in it, since
+// reading starts the clock on read-once messages.
+func (s *Server) MarkRead(ctx context.Context, userID, roomID, messageID string) (*model.ReadMarker, error) {
+	if !s.CanAccess(ctx, userID, roomID) {
+		return nil, ErrMessageNotFound
+	}
+	msg, err := s.store.Get(ctx, messageID)
+	if err != nil || msg.RoomID != roomID {
+		return nil, ErrMessageNotFound
+	}
+	m := &model.ReadMarker{
+		UserID:    userID,
+		RoomID:    roomID,
+		MessageID: msg.ID,
+		Seq:       msg.Seq,
+		Timestamp: time.Now().Unix(),
+	}
+	moved, err := s.reads.Advance(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if moved {
+		if err := s.store.StartExpiry(ctx, roomID, userID, msg.Seq, m.Timestamp); err != nil {
+			s.log.Error("failed to start message expiry", zap.Error(err))
+		}
+		s.BroadcastEvent(roomID, "", model.Event{
+			Event:     "read_receipt",
+			RoomID:    roomID,
+			UserID:    userID,
+			Data:      m,
+			Timestamp: m.Timestamp,
+		})
+	}
+	return m, nil
+}
+
+// UnreadCounts returns, for every room userID belongs to, how many
+// messages from others arrived after their read marker.
+func (s *Server) UnreadCounts(ctx context.Context, userID string) ([]*model.UnreadCount, error) {
+	rooms, err := s.rooms.ListByMember(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]*model.UnreadCount, 0, len(rooms))
+	for _, r := range rooms {
+		c := &model.UnreadCount{RoomID: r.ID}
+		if m, err := s.reads.Get(ctx, userID, r.ID); err == nil {
+			c.LastReadMessageID = m.MessageID
+			c.LastReadSeq = m.Seq
+		}
+		c.Unread, err = s.store.CountAfter(ctx, r.ID, c.LastReadSeq, userID)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, nil
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidPolicy  = errors.New("max age and max count must not be negative")
+	ErrPolicyNotFound = errors.New("retention policy not found")
+)
+
+// purgePause is how long the purger waits between batches so writers are
+// never kept waiting on it for long.
+const purgePause = 100 * time.Millisecond
+
+func (s *Server) retentionLoop() {
+	if s.cfg.RetentionEvery <= 0 {
+		return
+	}
+	t := time.NewTicker(s.cfg.RetentionEvery)
+	defer t.Stop()
+	for range t.C {
+		s.PurgeExpired(context.Background())
+		s.purgeDeletedRooms(context.Background())
+		s.sweepUploads(context.Background())
+	}
+}
+
+// GlobalRetention returns the policy for rooms without their own: the
+// stored one if an admin set it, else WS_RETENTION_MAX_AGE and
+// WS_RETENTION_MAX_COUNT.
+func (s *Server) GlobalRetention(ctx context.Context) (*model.RetentionPolicy, error) {
+	p, err := s.retention.Get(ctx, "")
+	if err == nil {
+		return p, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return &model.RetentionPolicy{
+		MaxAge:   int64(s.cfg.RetentionMaxAge / time.Second),
+		MaxCount: s.cfg.RetentionMaxKeep,
+	}, nil
+}
+
+// RoomRetention returns the policy roomID has of its own.
+func (s *Server) RoomRetention(ctx context.Context, roomID string) (*model.RetentionPolicy, error) {
+	p, err := s.retention.Get(ctx, roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPolicyNotFound
+	}
+	return p, err
+}
+
+// onHold reports whether roomID is under legal hold, through its own
+// policy or the global one.
+func (s *Server) onHold(ctx context.Context, roomID string) (bool, error) {
+	global, err := s.GlobalRetention(ctx)
+	if err != nil {
+		return false, err
+	}
+	if global.LegalHold {
+		return true, nil
+	}
+	p, err := s.retention.Get(ctx, roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return p.LegalHold, nil
+}
+
+// RoomRetentions lists the rooms that have a policy of their own.
+func (s *Server) RoomRetentions(ctx context.Context) ([]*model.RetentionPolicy, error) {
+	all, err := s.retention.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rooms := []*model.RetentionPolicy{}
+	for _, p := range all {
+		if p.RoomID != "" {
+			rooms = append(rooms, p)
+		}
+	}
+	return rooms, nil
+}
+
+// SetRetention stores p on behalf of userID; an empty RoomID sets the
+// global policy. A room policy needs the room to exist, though it may be
+// deleted and awaiting its purge, or, for an ad hoc room, to have
+// messages.
+func (s *Server) SetRetention(ctx context.Context, userID string, p *model.RetentionPolicy) error {
+	if p.MaxAge < 0 || p.MaxCount < 0 {
+		return ErrInvalidPolicy
+	}
+	if p.RoomID != "" {
+		room, err := s.rooms.Get(ctx, p.RoomID)
+		if errors.Is(err, sql.ErrNoRows) {
+			msgs, lerr := s.store.ListByRoom(ctx, p.RoomID, 1)
+			if lerr != nil {
+				return lerr
+			}
+			if len(msgs) == 0 {
+				return ErrRoomNotFound
+			}
+		} else if err != nil {
+			return err
+		} else if room.Purged {
+			return ErrRoomNotFound
+		}
+	}
+	p.UpdatedBy = userID
+	p.UpdatedAt = time.Now().Unix()
+	if err := s.retention.Set(ctx, p); err != nil {
+		return err
+	}
+	s.log.Info("retention policy changed", zap.String("room", p.RoomID), zap.String("by", userID),
+		zap.Int64("max_age", p.MaxAge), zap.Int("max_count", p.MaxCount), zap.Bool("legal_hold", p.LegalHold))
+	return nil
+}
+
+// DeleteRetention drops roomID's own policy so the global one applies
+// again, or resets the global policy to its configured default.
+func (s *Server) DeleteRetention(ctx context.Context, roomID string) error {
+	ok, err := s.retention.Delete(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if !ok && roomID != "" {
+		return ErrPolicyNotFound
+	}
+	return nil
+}
+
+// PurgeExpired deletes every message its room's policy no longer keeps
+// and returns how many went. It works in batches of RetentionBatch, each
+// in its own short transaction.
+func (s *Server) PurgeExpired(ctx context.Context) int {
+	global, err := s.GlobalRetention(ctx)
+	if err != nil {
+		s.log.Error("failed to load retention policy", zap.Error(err))
+		return 0
+	}
+	if global.LegalHold {
+		return 0
+	}
+	policies, err := s.retention.List(ctx)
+	if err != nil {
+		s.log.Error("failed to load retention policies", zap.Error(err))
+		return 0
+	}
+	own := make(map[string]*model.RetentionPolicy, len(policies))
+	for _, p := range policies {
+		own[p.RoomID] = p
+	}
+	roomIDs, err := s.store.RoomIDs(ctx)
+	if err != nil {
+		s.log.Error("failed to list rooms", zap.Error(err))
+		return 0
+	}
+	now := time.Now().Unix()
+	total := 0
+	for _, roomID := range roomIDs {
+		p := global
+		if o, ok := own[roomID]; ok && roomID != "" {
+			p = o
+		}
+		if p.LegalHold || (p.MaxAge <= 0 && p.MaxCount <= 0) {
+			continue
+		}
+		n, err := s.purgeRoom(ctx, roomID, p, now)
+		total += n
+		if err != nil {
+			s.log.Error("failed to purge room", zap.String("room", roomID), zap.Error(err))
+		}
+	}
+	if total > 0 {
+		s.log.Info("purged expired messages", zap.Int("count", total))
+	}
+	return total
+}
+
+func (s *Server) purgeRoom(ctx context.Context, roomID string, p *model.RetentionPolicy, now int64) (int, error) {
+	batch := s.purgeBatch()
+	var before int64
+	if p.MaxAge > 0 {
+		before = now - p.MaxAge
+	}
+	total := 0
+	for {
+		ids, err := s.store.Expired(ctx, roomID, before, p.MaxCount, batch)
+		if err != nil || len(ids) == 0 {
+			return total, err
+		}
+		if err := s.removeMessages(ctx, ids); err != nil {
+			return total, err
+		}
+		total += len(ids)
+		if len(ids) < batch {
+			return total, nil
+		}
+		time.Sleep(purgePause)
+	}
+}
+
+// purgeBatch is how many messages the purger deletes at a time.
+func (s *Server) purgeBatch() int {
+	if s.cfg.RetentionBatch <= 0 {
+		return 500
+	}
+	return s.cfg.RetentionBatch
+}
+
+// removeMessages permanently deletes ids along with their reactions,
+// mentions, pins and attachment files.
+func (s *Server) removeMessages(ctx context.Context, ids []string) error {
+	if err := s.store.Remove(ctx, ids); err != nil {
+		return err
+	}
+	s.forgetMessages(ctx, ids)
+	return nil
+}
+
+// forgetMessages drops what refers to the deleted messages ids: their
+// search entries, reactions, mentions, pins and attachments.
+func (s *Server) forgetMessages(ctx context.Context, ids []string) {
+	for _, id := range ids {
+		if err := s.search.Remove(ctx, id); err != nil {
+			s.log.Error("failed to unindex message", zap.Error(err))
+		}
+	}
+	if err := s.reactions.DeleteByMessages(ctx, ids); err != nil {
+		s.log.Error("failed to delete reactions", zap.Error(err))
+	}
+	if err := s.mentions.DeleteByMessages(ctx, ids); err != nil {
+		s.log.Error("failed to delete mentions", zap.Error(err))
+	}
+	if err := s.pins.DeleteByMessages(ctx, ids); err != nil {
+		s.log.Error("failed to delete pins", zap.Error(err))
+	}
+	removed, err := s.attachments.DeleteByMessages(ctx, ids)
+	if err != nil {
+		s.log.Error("failed to delete attachments", zap.Error(err))
+	}
+	s.deleteFiles(ctx, removed)
+}
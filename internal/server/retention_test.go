@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+)
+
+func TestSetRetentionRooms(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	if err := s.rooms.Create(ctx, &model.Room{ID: "named", Name: "named", Members: []string{"owner"}, OwnerID: "owner"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.postMessage(ctx, &model.Message{UserID: "owner", RoomID: "adhoc", Content: "hi"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		roomID  string
+		wantErr error
+	}{
+		{"global", "", nil},
+		{"named room", "named", nil},
+		{"ad hoc room with messages", "adhoc", nil},
+		{"unknown room", "nowhere", ErrRoomNotFound},
+	}
+	for _, tt := range tests {
+		err := s.SetRetention(ctx, "admin", &model.RetentionPolicy{RoomID: tt.roomID, LegalHold: true})
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	ErrRoomNotFound    = errors.New("room not found")
+	ErrInvalidRoomMeta = errors.New("invalid room metadata")
+	ErrRoomArchived    = errors.New("room is archived")
+	ErrRoomNotDeleted  = errors.New("room is not deleted")
+	ErrLegalHold       = errors.New("room is under legal hold")
+)
+
+// Limits on room metadata, in bytes unless noted.
+const (
+	maxRoomName    = 100
+	maxTopic       = 250
+	maxDescription = 2000
+	maxAvatarURL   = 2048
+	maxAttributes  = 32 // entries
+	maxAttrKey     = 64
+	maxAttrValue   = 1024
+)
+
+var attrKey = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// RoomUpdate holds the room fields to change. Nil fields stay as they
+// are, and a nil attribute value removes that attribute. Only the room's
+// moderators may rename or archive it.
+type RoomUpdate struct {
+	Name        *string
+	Archived    *bool
+	Topic       *string
+	Description *string
+	AvatarURL   *string
+	Attributes  map[string]*string
+}
+
+// canManage reports whether userID may change room's settings and pins:
+// its moderators can, and so can every member of a direct conversation,
+// which has no owner.
+func (s *Server) canManage(ctx context.Context, userID string, room *model.Room) bool {
+	if room.Direct {
+		return room.HasMember(userID)
+	}
+	return s.CanModerate(ctx, userID, room.ID)
+}
+
+// visibleRoom returns roomID if userID is allowed to see it.
+func (s *Server) visibleRoom(ctx context.Context, userID, roomID string) (*model.Room, error) {
+	room, err := s.rooms.Get(ctx, roomID)
+	if err != nil || room.DeletedAt != 0 || (room.Direct && !room.HasMember(userID)) {
+		return nil, ErrRoomNotFound
+	}
+	return room, nil
+}
+
+// checkOpen returns ErrRoomArchived if roomID is archived and so takes no
+// new messages, edits or reactions.
+func (s *Server) checkOpen(ctx context.Context, roomID string) error {
+	room, err := s.rooms.Get(ctx, roomID)
+	if err == nil && room.Archived {
+		return ErrRoomArchived
+	}
+	return nil
+}
+
+// UpdateRoom applies u to roomID on behalf of userID and tells the room
+// with a room_updated event. Renaming, archiving and unarchiving also
+// leave a system message in the room.
+func (s *Server) UpdateRoom(ctx context.Context, userID, roomID string, u *RoomUpdate) (*model.Room, error) {
+	room, err := s.visibleRoom(ctx, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !s.canManage(ctx, userID, room) {
+		return nil, ErrForbidden
+	}
+	if (u.Name != nil || u.Archived != nil) && (room.Direct || !s.CanModerate(ctx, userID, room.ID)) {
+		return nil, ErrForbidden
+	}
+	oldName, wasArchived := room.Name, room.Archived
+	if u.Name != nil {
+		room.Name = *u.Name
+	}
+	if u.Archived != nil {
+		room.Archived = *u.Archived
+	}
+	if u.Topic != nil {
+		room.Topic = *u.Topic
+	}
+	if u.Description != nil {
+		room.Description = *u.Description
+	}
+	if u.AvatarURL != nil {
+		room.AvatarURL = *u.AvatarURL
+	}
+	for k, v := range u.Attributes {
+		if v == nil {
+			delete(room.Attributes, k)
+			continue
+		}
+		if room.Attributes == nil {
+			room.Attributes = make(map[string]string)
+		}
+		room.Attributes[k] = *v
+	}
+	if err := checkRoomMeta(room); err != nil {
+		return nil, err
+	}
+	if err := s.rooms.Update(ctx, room); err != nil {
+		return nil, err
+	}
+	s.BroadcastEvent(room.ID, "", model.Event{
+		Event:     "room_updated",
+		RoomID:    room.ID,
+		UserID:    userID,
+		Data:      room,
+		Timestamp: time.Now().Unix(),
+	})
+	if room.Name != oldName {
+		s.postNotice(ctx, room.ID, userID, model.SystemBody{Event: "room_renamed", Name: room.Name},
+			fmt.Sprintf("renamed the room to %q", room.Name))
+	}
+	switch {
+	case room.Archived && !wasArchived:
+		s.postNotice(ctx, room.ID, userID, model.SystemBody{Event: "room_archived"}, "archived the room")
+	case !room.Archived && wasArchived:
+		s.postNotice(ctx, room.ID, userID, model.SystemBody{Event: "room_unarchived"}, "unarchived the room")
+	}
+	return room, nil
+}
+
+func checkRoomMeta(room *model.Room) error {
+	switch {
+	case !room.Direct && (room.Name == "" || len(room.Name) > maxRoomName):
+		return fmt.Errorf("%w: name must be 1 to %d bytes", ErrInvalidRoomMeta, maxRoomName)
+	case len(room.Topic) > maxTopic:
+		return fmt.Errorf("%w: topic too long", ErrInvalidRoomMeta)
+	case len(room.Description) > maxDescription:
+		return fmt.Errorf("%w: description too long", ErrInvalidRoomMeta)
+	case room.AvatarURL != "" && (len(room.AvatarURL) > maxAvatarURL || !webURL(room.AvatarURL)):
+		return fmt.Errorf("%w: avatar must be an http or https URL", ErrInvalidRoomMeta)
+	case len(room.Attributes) > maxAttributes:
+		return fmt.Errorf("%w: too many attributes", ErrInvalidRoomMeta)
+	}
+	for k, v := range room.Attributes {
+		if len(k) > maxAttrKey || !attrKey.MatchString(k) {
+			return fmt.Errorf("%w: bad attribute name %q", ErrInvalidRoomMeta, k)
+		}
+		if len(v) > maxAttrValue {
+			return fmt.Errorf("%w: attribute %q too long", ErrInvalidRoomMeta, k)
+		}
+	}
+	return nil
+}
+
+// DeleteRoom deletes roomID on behalf of one of its moderators. The room
+// can be restored for RoomRestoreFor, after which it is removed for good;
+// with hard set it is removed right away, unless it is under legal hold.
+// Either way everyone in the room gets a room_deleted event and is moved
+// out of it.
+func (s *Server) DeleteRoom(ctx context.Context, userID, roomID string, hard bool) error {
+	room, err := s.rooms.Get(ctx, roomID)
+	if err != nil || room.Purged || (room.DeletedAt != 0 && !hard) {
+		return ErrRoomNotFound
+	}
+	if !s.CanModerate(ctx, userID, room.ID) {
+		if room.DeletedAt != 0 || (room.Direct && !room.HasMember(userID)) {
+			return ErrRoomNotFound
+		}
+		return ErrForbidden
+	}
+	if hard {
+		held, err := s.onHold(ctx, room.ID)
+		if err != nil {
+			return err
+		}
+		if held {
+			return ErrLegalHold
+		}
+	}
+	now := time.Now().Unix()
+	if room.DeletedAt == 0 {
+		if err := s.rooms.SetDeleted(ctx, room.ID, now); err != nil {
+			return err
+		}
+		room.DeletedAt = now
+		s.closeRoom(room, userID)
+	}
+	s.log.Info("room deleted", zap.String("room", room.ID), zap.String("by", userID), zap.Bool("hard", hard))
+	if hard {
+		return s.destroyRoom(ctx, room)
+	}
+	return nil
+}
+
+// RestoreRoom undoes the deletion of roomID within the restore window and
+// announces it with a room_restored event to the same audience that was
+// told it was deleted.
+func (s *Server) RestoreRoom(ctx context.Context, userID, roomID string) (*model.Room, error) {
+	room, err := s.rooms.Get(ctx, roomID)
+	if err != nil || room.Purged || !s.CanModerate(ctx, userID, roomID) {
+		return nil, ErrRoomNotFound
+	}
+	if room.DeletedAt == 0 {
+		return nil, ErrRoomNotDeleted
+	}
+	if s.cfg.RoomRestoreFor > 0 && time.Since(time.Unix(room.DeletedAt, 0)) > s.cfg.RoomRestoreFor {
+		return nil, ErrRoomNotFound
+	}
+	if err := s.rooms.SetDeleted(ctx, room.ID, 0); err != nil {
+		return nil, err
+	}
+	room.DeletedAt = 0
+	s.openRoom(room, userID)
+	return room, nil
+}
+
+// openRoom tells everyone who may have been sent room_deleted by closeRoom
+// that room is back, so clients that were looking at it can rejoin. A
+// direct room only ever reached its members; anyone may have had a named
+// room open, so every connection hears about it.
+func (s *Server) openRoom(room *model.Room, userID string) {
+	b, err := json.Marshal(model.Event{
+		Event:     "room_restored",
+		RoomID:    room.ID,
+		UserID:    userID,
+		Data:      room,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		s.log.Error("marshal error", zap.Error(err))
+		return
+	}
+	s.mu.Lock()
+	targets := make(map[*websocket.Conn]bool)
+	for id, conns := range s.sessions {
+		if room.Direct && !room.HasMember(id) {
+			continue
+		}
+		for ws := range conns {
+			targets[ws] = true
+		}
+	}
+	s.mu.Unlock()
+	s.deliver(targets, b)
+}
+
+// closeRoom tells room's members, wherever they are, and anyone else
+// looking at it that it is gone. Their connections are moved out of it and
+// lose its thread subscriptions and typing indicators.
+func (s *Server) closeRoom(room *model.Room, userID string) {
+	b, err := json.Marshal(model.Event{
+		Event:     "room_deleted",
+		RoomID:    room.ID,
+		UserID:    userID,
+		Data:      room,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		s.log.Error("marshal error", zap.Error(err))
+		return
+	}
+	s.mu.Lock()
+	targets := s.roomTargets(room.ID, "")
+	for _, id := range room.Members {
+		for ws := range s.sessions[id] {
+			targets[ws] = true
+		}
+	}
+	for ws, roomID := range s.connRooms {
+		if roomID == room.ID {
+			delete(s.connRooms, ws)
+		}
+	}
+	for _, subs := range s.threads {
+		for rootID, roomID := range subs {
+			if roomID == room.ID {
+				delete(subs, rootID)
+			}
+		}
+	}
+	for key, t := range s.typing {
+		if key.roomID == room.ID {
+			t.Stop()
+			delete(s.typing, key)
+		}
+	}
+	delete(s.directs, room.ID)
+	s.mu.Unlock()
+	s.deliver(targets, b)
+}
+
+// purgeDeletedRooms removes the rooms whose restore window has passed,
+// leaving those under legal hold until the hold is lifted.
+func (s *Server) purgeDeletedRooms(ctx context.Context) {
+	if s.cfg.RoomRestoreFor <= 0 {
+		return
+	}
+	rooms, err := s.rooms.ListDeleted(ctx, time.Now().Add(-s.cfg.RoomRestoreFor).Unix())
+	if err != nil {
+		s.log.Error("failed to list deleted rooms", zap.Error(err))
+		return
+	}
+	for _, room := range rooms {
+		if err := s.destroyRoom(ctx, room); err != nil && !errors.Is(err, ErrLegalHold) {
+			s.log.Error("failed to remove room", zap.String("room", room.ID), zap.Error(err))
+		}
+	}
+}
+
+// destroyRoom removes a deleted room for good: its messages, in batches
+// as the retention purger does, then its uploads, read markers, pending
+// scheduled messages and retention policy, and finally the room's member
+// list and metadata, leaving a tombstone that keeps its ID closed. A room
+// under legal hold is left alone with ErrLegalHold.
+func (s *Server) destroyRoom(ctx context.Context, room *model.Room) error {
+	held, err := s.onHold(ctx, room.ID)
+	if err != nil {
+		return err
+	}
+	if held {
+		return ErrLegalHold
+	}
+	batch := s.purgeBatch()
+	for {
+		ids, err := s.store.DeleteByRoom(ctx, room.ID, batch)
+		if err != nil {
+			return err
+		}
+		s.forgetMessages(ctx, ids)
+		if len(ids) < batch {
+			break
+		}
+		time.Sleep(purgePause)
+	}
+	removed, err := s.attachments.DeleteByRoom(ctx, room.ID)
+	if err != nil {
+		return err
+	}
+	s.deleteFiles(ctx, removed)
+	if err := s.reads.DeleteByRoom(ctx, room.ID); err != nil {
+		return err
+	}
+	if err := s.scheduled.DeleteByRoom(ctx, room.ID); err != nil {
+		return err
+	}
+	if _, err := s.retention.Delete(ctx, room.ID); err != nil {
+		return err
+	}
+	return s.rooms.Purge(ctx, room.ID)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRoomRequired     = errors.New("room required")
+	ErrScheduleNotFound = errors.New("scheduled message not found")
+	ErrInvalidSendAt    = errors.New("send time must be in the future and within a year")
+	ErrTooManyScheduled = errors.New("too many scheduled messages")
+)
+
+const (
+	maxScheduled     = 100
+	maxScheduleAhead = 365 * 24 * 60 * 60
+	scheduleBatch    = 100
+	// scheduleClaimFor is how long a message being sent stays claimed; a
+	// claim older than this was left by a crash and is retried.
+	scheduleClaimFor = 5 * time.Minute
+	// scheduleRetry is the delay before the first retry after a failed
+	// try, doubling each time up to maxScheduleAttempts tries.
+	scheduleRetry       = 30 * time.Second
+	maxScheduleAttempts = 5
+)
+
+// checkMessage runs the checks a message from msg.UserID has to pass
+// before it can be sent, normalizing its content and resolving its thread
+// root on the way.
+func (s *Server) checkMessage(ctx context.Context, msg *model.Message, attachments int) error {
+	if msg.RoomID == "" {
+		return ErrRoomRequired
+	}
+	if err := normalizeContent(msg); err != nil {
+		return err
+	}
+	if err := s.checkTTL(msg); err != nil {
+		return err
+	}
+	if msg.Content == "" && attachments == 0 {
+		return ErrEmptyContent
+	}
+	if attachments > maxAttachments {
+		return ErrInvalidAttachments
+	}
+	if !s.CanAccess(ctx, msg.UserID, msg.RoomID) {
+		return ErrForbidden
+	}
+	if err := s.checkOpen(ctx, msg.RoomID); err != nil {
+		return err
+	}
+	if msg.ParentID != "" {
+		root, err := s.threadRoot(ctx, msg.RoomID, msg.ParentID)
+		if err != nil {
+			return err
+		}
+		msg.ParentID = root.ID
+	}
+	return nil
+}
+
+// schedule queues msg, already checked, to be sent at sendAt.
+func (s *Server) schedule(ctx context.Context, msg *model.Message, attachmentIDs []string, sendAt int64) (*model.ScheduledMessage, error) {
+	now := time.Now().Unix()
+	if sendAt <= now || sendAt > now+maxScheduleAhead {
+		return nil, ErrInvalidSendAt
+	}
+	if len(attachmentIDs) > maxAttachments {
+		return nil, ErrInvalidAttachments
+	}
+	n, err := s.scheduled.CountByUser(ctx, msg.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if n >= maxScheduled {
+		return nil, ErrTooManyScheduled
+	}
+	sm := &model.ScheduledMessage{
+		ID:            uuid.NewString(),
+		UserID:        msg.UserID,
+		RoomID:        msg.RoomID,
+		Content:       msg.Content,
+		Type:          msg.Type,
+		Body:          msg.Body,
+		ParentID:      msg.ParentID,
+		TTL:           msg.TTL,
+		ExpireMode:    msg.ExpireMode,
+		AttachmentIDs: attachmentIDs,
+		SendAt:        sendAt,
+		CreatedAt:     now,
+	}
+	if err := s.scheduled.Create(ctx, sm); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+// ScheduleMessage queues sm to be sent by userID at its SendAt.
+func (s *Server) ScheduleMessage(ctx context.Context, userID string, sm *model.ScheduledMessage) (*model.ScheduledMessage, error) {
+	sm.UserID = userID
+	msg := sm.Message()
+	if err := s.checkMessage(ctx, msg, len(sm.AttachmentIDs)); err != nil {
+		return nil, err
+	}
+	return s.schedule(ctx, msg, sm.AttachmentIDs, sm.SendAt)
+}
+
+// ScheduledMessages lists userID's pending messages, the next one first.
+func (s *Server) ScheduledMessages(ctx context.Context, userID string) ([]*model.ScheduledMessage, error) {
+	list, err := s.scheduled.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []*model.ScheduledMessage{}
+	}
+	return list, nil
+}
+
+// ScheduledMessage returns one of userID's pending messages.
+func (s *Server) ScheduledMessage(ctx context.Context, userID, id string) (*model.ScheduledMessage, error) {
+	sm, err := s.scheduled.Get(ctx, id)
+	if err != nil || sm.UserID != userID {
+		return nil, ErrScheduleNotFound
+	}
+	return sm, nil
+}
+
+// UpdateScheduled saves changes userID made to one of their pending
+// messages. Its room, thread and attachments stay as they were.
+func (s *Server) UpdateScheduled(ctx context.Context, userID string, sm *model.ScheduledMessage) (*model.ScheduledMessage, error) {
+	old, err := s.ScheduledMessage(ctx, userID, sm.ID)
+	if err != nil {
+		return nil, err
+	}
+	sm.UserID, sm.RoomID, sm.ParentID, sm.AttachmentIDs, sm.CreatedAt = old.UserID, old.RoomID, old.ParentID, old.AttachmentIDs, old.CreatedAt
+	msg := sm.Message()
+	if err := s.checkMessage(ctx, msg, len(sm.AttachmentIDs)); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if sm.SendAt <= now || sm.SendAt > now+maxScheduleAhead {
+		return nil, ErrInvalidSendAt
+	}
+	sm.Content, sm.Type, sm.Body, sm.ExpireMode = msg.Content, msg.Type, msg.Body, msg.ExpireMode
+	sm.UpdatedAt = now
+	if err := s.scheduled.Update(ctx, sm); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, err
+	}
+	return sm, nil
+}
+
+// CancelScheduled drops one of userID's pending messages.
+func (s *Server) CancelScheduled(ctx context.Context, userID, id string) error {
+	if _, err := s.ScheduledMessage(ctx, userID, id); err != nil {
+		return err
+	}
+	ok, err := s.scheduled.Cancel(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+func (s *Server) scheduleLoop() {
+	if s.cfg.ScheduleEvery <= 0 {
+		return
+	}
+	t := time.NewTicker(s.cfg.ScheduleEvery)
+	defer t.Stop()
+	for range t.C {
+		s.sendDue(context.Background())
+	}
+}
+
+// sendDue sends every scheduled message whose time has come, including
+// those that fell due while the server was down.
+func (s *Server) sendDue(ctx context.Context) {
+	for {
+		now := time.Now()
+		due, err := s.scheduled.Due(ctx, now.Unix(), now.Add(-scheduleClaimFor).Unix(), scheduleBatch)
+		if err != nil {
+			s.log.Error("failed to list scheduled messages", zap.Error(err))
+			return
+		}
+		for _, sm := range due {
+			s.sendScheduled(ctx, sm)
+		}
+		if len(due) < scheduleBatch {
+			return
+		}
+	}
+}
+
+// sendScheduled sends sm as its author, checking again that they may
+// still post where it is going, and tells them with a scheduled_sent or
+// scheduled_failed event. sm stays queued, claimed, until its message is
+// saved, and a save that fails is retried later; sm's ID becomes the
+// message's, so a message saved just before a crash is not sent twice.
+func (s *Server) sendScheduled(ctx context.Context, sm *model.ScheduledMessage) {
+	now := time.Now()
+	ok, err := s.scheduled.Claim(ctx, sm.ID, now.Unix(), now.Add(-scheduleClaimFor).Unix())
+	if err != nil {
+		s.log.Error("failed to claim scheduled message", zap.Error(err))
+		return
+	}
+	if !ok {
+		return
+	}
+	msg := sm.Message()
+	msg.ID = sm.ID
+	if _, gerr := s.store.Get(ctx, msg.ID); gerr == nil {
+		s.finishScheduled(ctx, sm, msg, nil)
+		return
+	}
+	disabled, err := s.disabled(ctx, sm.UserID)
+	retryable := err != nil
+	if err == nil && disabled {
+		err = ErrForbidden
+	} else if err == nil {
+		if err = s.checkMessage(ctx, msg, len(sm.AttachmentIDs)); err == nil {
+			err = s.postMessage(ctx, msg, sm.AttachmentIDs, nil)
+			retryable = err != nil && !errors.Is(err, ErrInvalidAttachments)
+		}
+	}
+	if retryable && sm.Attempts+1 < maxScheduleAttempts {
+		retry := now.Add(scheduleRetry << sm.Attempts).Unix()
+		s.log.Warn("scheduled message not sent, will retry", zap.String("id", sm.ID), zap.Error(err))
+		if rerr := s.scheduled.Release(ctx, sm.ID, retry); rerr != nil {
+			s.log.Error("failed to requeue scheduled message", zap.Error(rerr))
+		}
+		return
+	}
+	s.finishScheduled(ctx, sm, msg, err)
+}
+
+// finishScheduled takes sm off the queue once it has been sent as msg,
+// or has failed for good with err, and tells its author.
+func (s *Server) finishScheduled(ctx context.Context, sm *model.ScheduledMessage, msg *model.Message, err error) {
+	if derr := s.scheduled.Delete(ctx, sm.ID); derr != nil {
+		s.log.Error("failed to dequeue scheduled message", zap.Error(derr))
+	}
+	ev := model.Event{
+		Event:     "scheduled_sent",
+		RoomID:    sm.RoomID,
+		UserID:    sm.UserID,
+		Data:      sm,
+		Timestamp: time.Now().Unix(),
+	}
+	if err != nil {
+		s.log.Warn("scheduled message not sent", zap.String("id", sm.ID), zap.Error(err))
+		ev.Event = "scheduled_failed"
+		sm.Error = err.Error()
+	} else {
+		sm.MessageID = msg.ID
+	}
+	s.SendToUser(sm.UserID, ev)
+}
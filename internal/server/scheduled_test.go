@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+)
+
+func TestSendDue(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []*model.User{{ID: "local", Name: "local"}, {ID: "banned", Name: "banned"}} {
+		if err := s.users.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		userID   string
+		disable  bool
+		wantSent bool
+	}{
+		{"token-only user", "token-only", false, true},
+		{"local user", "local", false, true},
+		{"disabled user", "banned", true, false},
+	}
+	sendAt := time.Now().Unix() + 1
+	ids := make([]string, len(tests))
+	for i, tt := range tests {
+		sm, err := s.ScheduleMessage(ctx, tt.userID, &model.ScheduledMessage{RoomID: "lobby", Content: "later", SendAt: sendAt})
+		if err != nil {
+			t.Fatalf("%s: schedule: %v", tt.name, err)
+		}
+		ids[i] = sm.ID
+		if tt.disable {
+			if err := s.users.SetDisabled(ctx, tt.userID, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	time.Sleep(time.Until(time.Unix(sendAt+1, 0)))
+	s.sendDue(ctx)
+	for i, tt := range tests {
+		msg, err := s.store.Get(ctx, ids[i])
+		if sent := err == nil; sent != tt.wantSent {
+			t.Errorf("%s: sent %v, want %v", tt.name, sent, tt.wantSent)
+		} else if sent && msg.UserID != tt.userID {
+			t.Errorf("%s: sent as %q", tt.name, msg.UserID)
+		}
+		if _, err := s.scheduled.Get(ctx, ids[i]); err == nil {
+			t.Errorf("%s: still queued", tt.name)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+)
+
+// Search runs q on behalf of userID. The search is confined to rooms they
+// belong to; asking for another room finds nothing.
+func (s *Server) Search(ctx context.Context, userID, roomID string, q *model.SearchQuery) (*model.SearchPage, error) {
+	rooms, err := s.rooms.ListByMember(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	q.RoomIDs = q.RoomIDs[:0]
+	for _, r := range rooms {
+		if roomID == "" || r.ID == roomID {
+			q.RoomIDs = append(q.RoomIDs, r.ID)
+		}
+	}
+	page, err := s.search.Search(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*model.Message, len(page.Results))
+	for i, r := range page.Results {
+		msgs[i] = r.Message
+	}
+	s.FillMessages(ctx, msgs...)
+	return page, nil
+}
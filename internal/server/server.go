@@ -2,31 +2,80 @@ package server
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/1cbyc/go-websocket-server/internal/blob"
 	"github.com/1cbyc/go-websocket-server/internal/config"
 	"github.com/1cbyc/go-websocket-server/internal/model"
+	"github.com/1cbyc/go-websocket-server/internal/ratelimit"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"golang.org/x/net/websocket"
 )
 
+var (
+	ErrServerFull       = errors.New("server at connection capacity")
+	ErrTooManyUserConns = errors.New("too many connections for user")
+	ErrTooManyIPConns   = errors.New("too many connections from address")
+)
+
 type Server struct {
-	conns     map[*websocket.Conn]bool
-	connRooms map[*websocket.Conn]string
-	mu        sync.Mutex
-	cfg       *config.Config
-	log       *zap.Logger
-	store     model.MessageStore
-	presence  model.PresenceStore
-	rooms     model.RoomStore
+	conns       map[*websocket.Conn]bool
+	connRooms   map[*websocket.Conn]string
+	sessions    map[string]map[*websocket.Conn]*model.Device
+	activity    map[string]time.Time
+	autoAway    map[string]bool
+	presSubs    map[*websocket.Conn]map[string]bool
+	threads     map[*websocket.Conn]map[string]string
+	directs     map[string][]string
+	offline     map[string]*time.Timer
+	typing      map[typingKey]*time.Timer
+	active      int
+	userConns   map[string]int
+	ipConns     map[string]int
+	mu          sync.Mutex
+	cfg         *config.Config
+	log         *zap.Logger
+	store       model.MessageStore
+	presence    model.PresenceStore
+	rooms       model.RoomStore
+	users       model.UserStore
+	apiKeys     model.APIKeyStore
+	reads       model.ReadMarkerStore
+	reactions   model.ReactionStore
+	mentions    model.MentionStore
+	search      model.SearchIndex
+	attachments model.AttachmentStore
+	retention   model.RetentionStore
+	scheduled   model.ScheduledStore
+	pins        model.PinStore
+	blobs       blob.Store
+	msgLimit    *ratelimit.Limiter
+	connLimit   *ratelimit.Limiter
+	restLimit   *ratelimit.Limiter
+	typeLimit   *ratelimit.Limiter
 }
 
 func New(cfg *config.Config, log *zap.Logger) *Server {
+	var search model.SearchIndex
+	if !model.FTS5Available() {
+		if !cfg.SearchLike {
+			log.Fatal("built without sqlite_fts5; build with make, or set WS_SEARCH_LIKE=true to search with LIKE instead")
+		}
+		log.Warn("built without sqlite_fts5, search falls back to LIKE")
+		like, err := model.NewSQLiteLikeIndex(cfg.DBDSN)
+		if err != nil {
+			log.Fatal("failed to init search index", zap.Error(err))
+		}
+		search = like
+	}
 	store, err := model.NewSQLiteMessageStore(cfg.DBDSN)
 	if err != nil {
 		log.Fatal("failed to init message store", zap.Error(err))
@@ -39,63 +88,317 @@ func New(cfg *config.Config, log *zap.Logger) *Server {
 	if err != nil {
 		log.Fatal("failed to init room store", zap.Error(err))
 	}
-	return &Server{
-		conns:     make(map[*websocket.Conn]bool),
-		connRooms: make(map[*websocket.Conn]string),
-		cfg:       cfg,
-		log:       log,
-		store:     store,
-		presence:  presence,
-		rooms:     rooms,
+	users, err := model.NewSQLiteUserStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init user store", zap.Error(err))
+	}
+	apiKeys, err := model.NewSQLiteAPIKeyStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init api key store", zap.Error(err))
+	}
+	reads, err := model.NewSQLiteReadMarkerStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init read marker store", zap.Error(err))
+	}
+	reactions, err := model.NewSQLiteReactionStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init reaction store", zap.Error(err))
+	}
+	mentions, err := model.NewSQLiteMentionStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init mention store", zap.Error(err))
+	}
+	attachments, err := model.NewSQLiteAttachmentStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init attachment store", zap.Error(err))
 	}
+	retention, err := model.NewSQLiteRetentionStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init retention store", zap.Error(err))
+	}
+	scheduled, err := model.NewSQLiteScheduledStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init scheduled message store", zap.Error(err))
+	}
+	pins, err := model.NewSQLitePinStore(cfg.DBDSN)
+	if err != nil {
+		log.Fatal("failed to init pin store", zap.Error(err))
+	}
+	blobs, err := blob.NewLocalStore(cfg.BlobDir)
+	if err != nil {
+		log.Fatal("failed to init blob store", zap.Error(err))
+	}
+	if search == nil {
+		search, err = model.NewSQLiteFTSIndex(cfg.DBDSN)
+		if err != nil {
+			log.Fatal("failed to init search index", zap.Error(err))
+		}
+	}
+	s := &Server{
+		conns:       make(map[*websocket.Conn]bool),
+		connRooms:   make(map[*websocket.Conn]string),
+		sessions:    make(map[string]map[*websocket.Conn]*model.Device),
+		activity:    make(map[string]time.Time),
+		autoAway:    make(map[string]bool),
+		presSubs:    make(map[*websocket.Conn]map[string]bool),
+		threads:     make(map[*websocket.Conn]map[string]string),
+		directs:     make(map[string][]string),
+		offline:     make(map[string]*time.Timer),
+		typing:      make(map[typingKey]*time.Timer),
+		userConns:   make(map[string]int),
+		ipConns:     make(map[string]int),
+		cfg:         cfg,
+		log:         log,
+		store:       store,
+		presence:    presence,
+		rooms:       rooms,
+		users:       users,
+		apiKeys:     apiKeys,
+		reads:       reads,
+		reactions:   reactions,
+		mentions:    mentions,
+		search:      search,
+		attachments: attachments,
+		retention:   retention,
+		scheduled:   scheduled,
+		pins:        pins,
+		blobs:       blobs,
+		msgLimit:    ratelimit.New(cfg.RateMessages, cfg.RateMessageBurst),
+		connLimit:   ratelimit.New(cfg.RateConnects, cfg.RateConnectBurst),
+		restLimit:   ratelimit.New(cfg.RateREST, cfg.RateRESTBurst),
+		typeLimit:   ratelimit.New(cfg.RateTyping, cfg.RateTypingBurst),
+	}
+	s.recoverPresence()
+	go s.presenceLoop()
+	go s.reconcileLoop()
+	go s.retentionLoop()
+	go s.expiryLoop()
+	go s.scheduleLoop()
+	return s
 }
 
 func (s *Server) HandleWS(ws *websocket.Conn) {
-	s.mu.Lock()
-	s.conns[ws] = true
-	s.mu.Unlock()
-	userID := ws.Request().Header.Get("X-User-ID")
-	s.presence.Set(context.Background(), &model.Presence{
-		UserID:   userID,
-		Online:   true,
-		LastSeen: time.Now().Unix(),
-	})
+	req := ws.Request()
+	userID := req.Header.Get("X-User-ID")
+	dev := &model.Device{
+		SessionID:   uuid.NewString(),
+		Name:        deviceName(req),
+		ConnectedAt: time.Now().Unix(),
+	}
+	if s.addConn(ws, userID, dev) {
+		s.presence.SetOnline(context.Background(), userID, s.cfg.InstanceID, true, time.Now().Unix())
+		s.clearAutoAway(userID)
+		if !s.cancelOffline(userID) {
+			s.publishPresence(userID)
+		}
+	}
 	s.readLoop(ws)
 }
 
+// deviceName picks a label for a connection: the client's own ?device=
+// or X-Device-Name, falling back to its User-Agent.
+func deviceName(r *http.Request) string {
+	name := r.URL.Query().Get("device")
+	if name == "" {
+		name = r.Header.Get("X-Device-Name")
+	}
+	if name == "" {
+		name = r.UserAgent()
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// inbound is a client frame. Plain chat messages carry no Action; other
+// frames name what they want done and fill in the fields it needs.
+type inbound struct {
+	Action string
+	model.Message
+	Status        model.PresenceStatus
+	StatusText    string
+	StatusEmoji   string
+	StatusTTL     int64
+	UserIDs       []string
+	Typing        bool
+	MessageID     string
+	Emoji         string
+	To            []string
+	AttachmentIDs []string
+	SendAt        int64
+}
+
 func (s *Server) readLoop(ws *websocket.Conn) {
 	dec := json.NewDecoder(ws)
 	userID := ws.Request().Header.Get("X-User-ID")
 	for {
-		var msg model.Message
-		err := dec.Decode(&msg)
+		var f inbound
+		err := dec.Decode(&f)
 		if err != nil {
-			if err == io.EOF {
-				s.removeConn(ws)
-				s.presence.Set(context.Background(), &model.Presence{
-					UserID:   userID,
-					Online:   false,
-					LastSeen: time.Now().Unix(),
-				})
-				return
+			if err != io.EOF {
+				s.log.Warn("read error", zap.Error(err))
 			}
-			s.log.Error("read error", zap.Error(err))
-			continue
+			s.stopConnTyping(ws, userID)
+			if s.removeConn(ws, userID) {
+				s.presence.SetOnline(context.Background(), userID, s.cfg.InstanceID, false, time.Now().Unix())
+				s.scheduleOffline(userID)
+			}
+			return
 		}
-		if msg.Content == "" || msg.UserID == "" || msg.RoomID == "" {
-			s.log.Warn("invalid message", zap.Any("msg", msg))
-			continue
+		if s.touch(userID) {
+			s.clearAutoAway(userID)
+		}
+		switch f.Action {
+		case "", "message":
+			s.handleMessage(ws, userID, f)
+		case "status":
+			if err := s.SetStatus(context.Background(), userID, f.Status, f.StatusText, f.StatusEmoji, f.StatusTTL); err != nil {
+				s.sendError(ws, "invalid_status", err.Error(), 0)
+			}
+		case "read":
+			if _, err := s.MarkRead(context.Background(), userID, f.RoomID, f.MessageID); err != nil {
+				s.sendError(ws, "invalid_read", err.Error(), 0)
+			}
+		case "edit":
+			if _, err := s.EditMessage(context.Background(), userID, f.MessageID, f.Content); err != nil {
+				s.sendError(ws, "invalid_edit", err.Error(), 0)
+			}
+		case "delete":
+			if _, err := s.DeleteMessage(context.Background(), userID, f.MessageID); err != nil {
+				s.sendError(ws, "invalid_delete", err.Error(), 0)
+			}
+		case "thread_subscribe":
+			if err := s.subscribeThread(context.Background(), ws, userID, f.MessageID); err != nil {
+				s.sendError(ws, "invalid_thread", err.Error(), 0)
+			}
+		case "thread_unsubscribe":
+			s.unsubscribeThread(ws, f.MessageID)
+		case "react", "unreact":
+			s.handleReaction(ws, userID, f.Action == "react", f.MessageID, f.Emoji)
+		case "typing":
+			s.handleTyping(ws, userID, f.RoomID, f.Typing)
+		case "presence_subscribe":
+			s.subscribePresence(ws, f.UserIDs)
+		case "presence_unsubscribe":
+			s.unsubscribePresence(ws, f.UserIDs)
+		default:
+			s.sendError(ws, "unknown_action", "unknown action "+f.Action, 0)
+		}
+	}
+}
+
+// handleMessage stores and broadcasts a chat message. A message with To
+// instead of a RoomID goes to the direct conversation with those users,
+// which is opened if needed. AttachmentIDs name files uploaded to the
+// room beforehand. With a SendAt the message is scheduled instead.
+func (s *Server) handleMessage(ws *websocket.Conn, userID string, f inbound) {
+	ctx := context.Background()
+	if f.RoomID == "" && len(f.To) > 0 {
+		room, err := s.OpenConversation(ctx, userID, f.To)
+		if err != nil {
+			s.sendError(ws, "invalid_conversation", err.Error(), 0)
+			return
+		}
+		f.RoomID = room.ID
+	}
+	if ok, wait := s.msgLimit.Allow(userID + "|" + f.RoomID); !ok {
+		s.sendError(ws, "rate_limited", "too many messages", ratelimit.RetryAfter(wait))
+		return
+	}
+	msg := model.Message{UserID: userID, RoomID: f.RoomID, ParentID: f.ParentID, Content: f.Content, Type: f.Type, Body: f.Body, TTL: f.TTL, ExpireMode: f.ExpireMode}
+	if err := s.checkMessage(ctx, &msg, len(f.AttachmentIDs)); err != nil {
+		s.sendError(ws, messageErrorCode(err), err.Error(), 0)
+		return
+	}
+	if f.SendAt != 0 {
+		sm, err := s.schedule(ctx, &msg, f.AttachmentIDs, f.SendAt)
+		if err != nil {
+			s.sendError(ws, "invalid_schedule", err.Error(), 0)
+			return
+		}
+		s.send(ws, model.Event{
+			Event:     "message_scheduled",
+			RoomID:    sm.RoomID,
+			UserID:    userID,
+			Data:      sm,
+			Timestamp: sm.CreatedAt,
+		})
+		return
+	}
+	if err := s.postMessage(ctx, &msg, f.AttachmentIDs, ws); err != nil {
+		if errors.Is(err, ErrInvalidAttachments) {
+			s.sendError(ws, "invalid_attachments", err.Error(), 0)
+			return
 		}
+		s.sendError(ws, "save_failed", "message not saved", 0)
+	}
+}
+
+// messageErrorCode is the error code a client gets when checkMessage
+// turns its message down with err.
+func messageErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidContent), errors.Is(err, ErrContentTooLong):
+		return "invalid_content"
+	case errors.Is(err, ErrInvalidTTL):
+		return "invalid_ttl"
+	case errors.Is(err, ErrInvalidAttachments):
+		return "invalid_attachments"
+	case errors.Is(err, ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, ErrRoomArchived):
+		return "room_archived"
+	case errors.Is(err, ErrInvalidParent):
+		return "invalid_parent"
+	default:
+		return "invalid_message"
+	}
+}
+
+// postMessage gives msg its time, and an ID unless it has one, saves it
+// and sends it out to the room, thread followers and mentioned users. ws,
+// if not nil, is the sender's connection and moves to msg's room.
+func (s *Server) postMessage(ctx context.Context, msg *model.Message, attachmentIDs []string, ws *websocket.Conn) error {
+	if msg.ID == "" {
 		msg.ID = uuid.NewString()
-		msg.Timestamp = time.Now().Unix()
-		s.store.Save(context.Background(), &msg)
+	}
+	msg.Timestamp = time.Now().Unix()
+	if msg.ExpireMode == model.ExpireOnSend {
+		msg.ExpiresAt = msg.Timestamp + msg.TTL
+	}
+	if err := s.attach(ctx, msg, attachmentIDs); err != nil {
+		return err
+	}
+	if err := s.store.Save(ctx, msg); err != nil {
+		s.log.Error("failed to save message", zap.Error(err))
+		if len(attachmentIDs) > 0 {
+			if err := s.attachments.Detach(ctx, msg.ID); err != nil {
+				s.log.Error("failed to detach attachments", zap.Error(err))
+			}
+			msg.Attachments = nil
+		}
+		return err
+	}
+	if err := s.search.Index(ctx, msg); err != nil {
+		s.log.Error("failed to index message", zap.Error(err))
+	}
+	if ws != nil {
 		s.mu.Lock()
 		s.connRooms[ws] = msg.RoomID
 		s.mu.Unlock()
-		s.broadcast(msg)
 	}
+	s.stopTyping(ws, msg.UserID, msg.RoomID)
+	s.broadcast(*msg)
+	if msg.ParentID != "" {
+		s.publishThread(ctx, msg.ParentID)
+	}
+	s.notifyMentions(ctx, msg)
+	return nil
 }
 
+// broadcast sends msg to the connections in its room and, for a reply,
+// to those following its thread.
 func (s *Server) broadcast(msg model.Message) {
 	b, err := json.Marshal(msg)
 	if err != nil {
@@ -103,24 +406,191 @@ func (s *Server) broadcast(msg model.Message) {
 		return
 	}
 	s.mu.Lock()
-	for ws := range s.conns {
-		roomID := s.connRooms[ws]
-		if roomID == msg.RoomID {
-			go func(ws *websocket.Conn) {
-				if _, err := ws.Write(b); err != nil {
-					s.log.Error("write error", zap.Error(err))
-				}
-			}(ws)
-		}
+	targets := s.roomTargets(msg.RoomID, "")
+	if msg.ParentID != "" {
+		s.threadTargets(targets, msg.ParentID)
 	}
 	s.mu.Unlock()
+	s.deliver(targets, b)
 }
 
-func (s *Server) removeConn(ws *websocket.Conn) {
+// BroadcastEvent sends ev to every connection in roomID except those of
+// the user named by exclude.
+func (s *Server) BroadcastEvent(roomID, exclude string, ev model.Event) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		s.log.Error("marshal error", zap.Error(err))
+		return
+	}
+	s.mu.Lock()
+	targets := s.roomTargets(roomID, exclude)
+	s.mu.Unlock()
+	s.deliver(targets, b)
+}
+
+// roomTargets collects the connections whose current room is roomID,
+// skipping those of exclude. Direct conversations reach all of their
+// members' connections instead. The caller must hold s.mu.
+func (s *Server) roomTargets(roomID, exclude string) map[*websocket.Conn]bool {
+	targets := make(map[*websocket.Conn]bool)
+	if members, ok := s.directs[roomID]; ok {
+		for _, userID := range members {
+			if userID == exclude {
+				continue
+			}
+			for ws := range s.sessions[userID] {
+				targets[ws] = true
+			}
+		}
+		return targets
+	}
+	for userID, devs := range s.sessions {
+		if userID == exclude {
+			continue
+		}
+		for ws := range devs {
+			if s.connRooms[ws] == roomID {
+				targets[ws] = true
+			}
+		}
+	}
+	return targets
+}
+
+func (s *Server) send(ws *websocket.Conn, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		s.log.Error("marshal error", zap.Error(err))
+		return
+	}
+	if _, err := ws.Write(b); err != nil {
+		s.log.Error("write error", zap.Error(err))
+	}
+}
+
+// deliver writes an already encoded frame to each connection without
+// blocking the caller on slow clients.
+func (s *Server) deliver(targets map[*websocket.Conn]bool, b []byte) {
+	for ws := range targets {
+		go func(ws *websocket.Conn) {
+			if _, err := ws.Write(b); err != nil {
+				s.log.Error("write error", zap.Error(err))
+			}
+		}(ws)
+	}
+}
+
+func (s *Server) sendError(ws *websocket.Conn, code, message string, retryAfter int) {
+	s.send(ws, model.Event{
+		Event:     "error",
+		Data:      model.ErrorData{Code: code, Message: message, RetryAfter: retryAfter},
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// addConn registers ws as one of userID's sessions and reports whether it
+// is the user's first live connection.
+func (s *Server) addConn(ws *websocket.Conn, userID string, dev *model.Device) bool {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[ws] = true
+	devs, ok := s.sessions[userID]
+	if !ok {
+		devs = make(map[*websocket.Conn]*model.Device)
+		s.sessions[userID] = devs
+	}
+	devs[ws] = dev
+	s.activity[userID] = time.Now()
+	return len(devs) == 1
+}
+
+// removeConn drops ws and reports whether it was userID's last live
+// connection.
+func (s *Server) removeConn(ws *websocket.Conn, userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.conns, ws)
 	delete(s.connRooms, ws)
-	s.mu.Unlock()
+	delete(s.presSubs, ws)
+	delete(s.threads, ws)
+	devs := s.sessions[userID]
+	delete(devs, ws)
+	if len(devs) == 0 {
+		delete(s.sessions, userID)
+		delete(s.activity, userID)
+		delete(s.autoAway, userID)
+		s.forgetDirects(userID)
+		return true
+	}
+	return false
+}
+
+// Devices lists userID's live connections, oldest first.
+func (s *Server) Devices(userID string) []model.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devs := make([]model.Device, 0, len(s.sessions[userID]))
+	for _, d := range s.sessions[userID] {
+		devs = append(devs, *d)
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].ConnectedAt < devs[j].ConnectedAt })
+	return devs
+}
+
+// AcquireConn reserves a connection slot for userID connecting from ip,
+// enforcing the global, per-user and per-address limits. Every successful
+// call must be paired with ReleaseConn.
+func (s *Server) AcquireConn(userID, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg.MaxConns > 0 && s.active >= s.cfg.MaxConns {
+		return ErrServerFull
+	}
+	if s.cfg.MaxConnsPerUser > 0 && s.userConns[userID] >= s.cfg.MaxConnsPerUser {
+		return ErrTooManyUserConns
+	}
+	if s.cfg.MaxConnsPerIP > 0 && s.ipConns[ip] >= s.cfg.MaxConnsPerIP {
+		return ErrTooManyIPConns
+	}
+	s.active++
+	s.userConns[userID]++
+	s.ipConns[ip]++
+	return nil
+}
+
+func (s *Server) ReleaseConn(userID, ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.userConns[userID]--; s.userConns[userID] <= 0 {
+		delete(s.userConns, userID)
+	}
+	if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+}
+
+type ConnCounts struct {
+	Total  int
+	ByUser map[string]int
+	ByIP   map[string]int
+}
+
+func (s *Server) ConnCounts() ConnCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := ConnCounts{
+		Total:  s.active,
+		ByUser: make(map[string]int, len(s.userConns)),
+		ByIP:   make(map[string]int, len(s.ipConns)),
+	}
+	for k, v := range s.userConns {
+		c.ByUser[k] = v
+	}
+	for k, v := range s.ipConns {
+		c.ByIP[k] = v
+	}
+	return c
 }
 
 func (s *Server) Start() {
@@ -140,3 +610,56 @@ func (s *Server) Presence() model.PresenceStore {
 func (s *Server) RoomStore() model.RoomStore {
 	return s.rooms
 }
+
+func (s *Server) Users() model.UserStore {
+	return s.users
+}
+
+func (s *Server) ReadMarkers() model.ReadMarkerStore {
+	return s.reads
+}
+
+func (s *Server) APIKeys() model.APIKeyStore {
+	return s.apiKeys
+}
+
+func (s *Server) Config() *config.Config {
+	return s.cfg
+}
+
+func (s *Server) Logger() *zap.Logger {
+	return s.log
+}
+
+// disabled reports whether userID is a local account that was disabled.
+// As in auth.ValidateToken, a user the store does not know, who signed
+// in with a token alone, is not.
+func (s *Server) disabled(ctx context.Context, userID string) (bool, error) {
+	u, err := s.users.Get(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return u.Disabled, nil
+}
+
+// AllowConnect applies the per-IP limit on WebSocket upgrade attempts.
+func (s *Server) AllowConnect(ip string) (bool, time.Duration) {
+	return s.connLimit.Allow(ip)
+}
+
+// AllowREST applies the per-caller limit on REST requests.
+func (s *Server) AllowREST(key string) (bool, time.Duration) {
+	return s.restLimit.Allow(key)
+}
+
+func (s *Server) IsAdmin(userID string) bool {
+	for _, id := range s.cfg.AdminUsers {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/1cbyc/go-websocket-server/internal/config"
+	"go.uber.org/zap"
+)
+
+// newTestServer returns a server on a fresh database whose background
+// loops are off, so tests run them by hand.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("WS_DB_DSN", filepath.Join(dir, "test.db"))
+	t.Setenv("WS_BLOB_DIR", filepath.Join(dir, "blobs"))
+	t.Setenv("WS_SEARCH_LIKE", "true")
+	for _, key := range []string{"WS_RETENTION_INTERVAL", "WS_EXPIRE_INTERVAL", "WS_SCHEDULE_INTERVAL", "WS_PRESENCE_RECONCILE"} {
+		t.Setenv(key, "0s")
+	}
+	return New(config.Load(), zap.NewNop())
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// maxThreadSubs caps how many threads one connection can follow.
+const maxThreadSubs = 100
+
+var (
+	ErrInvalidParent  = errors.New("parent message not found in room")
+	ErrTooManyThreads = errors.New("too many thread subscriptions")
+)
+
+// threadRoot resolves the root of the thread a reply to parentID belongs
+// in. Threads are one level deep, so replying to a reply lands in the
+// same thread.
+func (s *Server) threadRoot(ctx context.Context, roomID, parentID string) (*model.Message, error) {
+	parent, err := s.store.Get(ctx, parentID)
+	if err != nil || parent.RoomID != roomID {
+		return nil, ErrInvalidParent
+	}
+	if parent.ParentID == "" {
+		return parent, nil
+	}
+	root, err := s.store.Get(ctx, parent.ParentID)
+	if err != nil {
+		return nil, ErrInvalidParent
+	}
+	return root, nil
+}
+
+// Thread returns a thread's root message and its latest replies, newest
+// first.
+func (s *Server) Thread(ctx context.Context, roomID, rootID string, limit int) (*model.Thread, error) {
+	root, err := s.store.Get(ctx, rootID)
+	if err != nil || root.RoomID != roomID || root.ParentID != "" {
+		return nil, ErrMessageNotFound
+	}
+	replies, err := s.store.ListReplies(ctx, root.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	s.FillMessages(ctx, append(replies, root)...)
+	return &model.Thread{Root: root, Replies: replies}, nil
+}
+
+// threadOf names the thread msg belongs to: its root, or itself if it is
+// a root.
+func threadOf(msg *model.Message) string {
+	if msg.ParentID != "" {
+		return msg.ParentID
+	}
+	return msg.ID
+}
+
+// publishThread tells the room and the thread's followers about the
+// root's new reply count and last reply time.
+func (s *Server) publishThread(ctx context.Context, rootID string) {
+	root, err := s.store.Get(ctx, rootID)
+	if err != nil {
+		return
+	}
+	s.broadcastThreadEvent(root.RoomID, root.ID, model.Event{
+		Event:     "thread_updated",
+		RoomID:    root.RoomID,
+		Data:      root,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// broadcastThreadEvent sends ev to the connections in roomID and to those
+// following threadID from elsewhere.
+func (s *Server) broadcastThreadEvent(roomID, threadID string, ev model.Event) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		s.log.Error("marshal error", zap.Error(err))
+		return
+	}
+	s.mu.Lock()
+	targets := s.roomTargets(roomID, "")
+	s.threadTargets(targets, threadID)
+	s.mu.Unlock()
+	s.deliver(targets, b)
+}
+
+// threadTargets adds the connections following threadID to targets. The
+// caller must hold s.mu.
+func (s *Server) threadTargets(targets map[*websocket.Conn]bool, threadID string) {
+	for ws, subs := range s.threads {
+		if _, ok := subs[threadID]; ok {
+			targets[ws] = true
+		}
+	}
+}
+
+// subscribeThread lets ws follow the thread rooted at rootID without
+// being in its room. Only those who may read the room, as CanAccess
+// decides, may follow a thread. Each subscription remembers the thread's
+// room so it can be dropped with it.
+func (s *Server) subscribeThread(ctx context.Context, ws *websocket.Conn, userID, rootID string) error {
+	root, err := s.store.Get(ctx, rootID)
+	if err != nil || root.ParentID != "" {
+		return ErrMessageNotFound
+	}
+	if !s.CanAccess(ctx, userID, root.RoomID) {
+		return ErrMessageNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs, ok := s.threads[ws]
+	if !ok {
+		subs = make(map[string]string)
+		s.threads[ws] = subs
+	}
+	if _, ok := subs[rootID]; !ok && len(subs) >= maxThreadSubs {
+		return ErrTooManyThreads
+	}
+	subs[rootID] = root.RoomID
+	return nil
+}
+
+func (s *Server) unsubscribeThread(ws *websocket.Conn, rootID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.threads[ws], rootID)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/1cbyc/go-websocket-server/internal/model"
+	"golang.org/x/net/websocket"
+)
+
+// typingKey names one connection's typing in a room, so a user typing on
+// two devices stops only when both do.
+type typingKey struct {
+	ws     *websocket.Conn
+	userID string
+	roomID string
+}
+
+// handleTyping relays a typing start or stop to the rest of the room.
+// Typing frames are never stored. A start that is not followed by a stop,
+// a message or another start within TypingTimeout is stopped for the
+// client.
+func (s *Server) handleTyping(ws *websocket.Conn, userID, roomID string, typing bool) {
+	if roomID == "" {
+		return
+	}
+	// Clients resend starts while the user keeps typing; extra ones are
+	// dropped quietly rather than answered with errors.
+	if typing {
+		if ok, _ := s.typeLimit.Allow(userID); !ok {
+			return
+		}
+	}
+	if !s.CanAccess(context.Background(), userID, roomID) {
+		return
+	}
+	if !typing {
+		s.stopTyping(ws, userID, roomID)
+		return
+	}
+	key := typingKey{ws: ws, userID: userID, roomID: roomID}
+	s.mu.Lock()
+	s.connRooms[ws] = roomID
+	if t, ok := s.typing[key]; ok {
+		t.Reset(s.cfg.TypingTimeout)
+		s.mu.Unlock()
+		return
+	}
+	already := s.isTyping(userID, roomID)
+	var t *time.Timer
+	t = time.AfterFunc(s.cfg.TypingTimeout, func() {
+		s.mu.Lock()
+		current := s.typing[key] == t
+		if current {
+			delete(s.typing, key)
+		}
+		stopped := current && !s.isTyping(userID, roomID)
+		s.mu.Unlock()
+		if stopped {
+			s.publishTyping(userID, roomID, false)
+		}
+	})
+	s.typing[key] = t
+	s.mu.Unlock()
+	if !already {
+		s.publishTyping(userID, roomID, true)
+	}
+}
+
+// stopTyping stops userID typing in roomID on ws, or on all of their
+// connections if ws is nil, and tells the room once they have stopped
+// everywhere.
+func (s *Server) stopTyping(ws *websocket.Conn, userID, roomID string) {
+	s.mu.Lock()
+	stopped := false
+	for conn := range s.sessions[userID] {
+		if ws != nil && conn != ws {
+			continue
+		}
+		key := typingKey{ws: conn, userID: userID, roomID: roomID}
+		if t, ok := s.typing[key]; ok {
+			t.Stop()
+			delete(s.typing, key)
+			stopped = true
+		}
+	}
+	stopped = stopped && !s.isTyping(userID, roomID)
+	s.mu.Unlock()
+	if stopped {
+		s.publishTyping(userID, roomID, false)
+	}
+}
+
+// stopConnTyping stops whatever ws, which is closing, was typing in.
+func (s *Server) stopConnTyping(ws *websocket.Conn, userID string) {
+	s.mu.Lock()
+	var rooms []string
+	for key, t := range s.typing {
+		if key.ws == ws {
+			t.Stop()
+			delete(s.typing, key)
+			rooms = append(rooms, key.roomID)
+		}
+	}
+	stopped := rooms[:0]
+	for _, roomID := range rooms {
+		if !s.isTyping(userID, roomID) {
+			stopped = append(stopped, roomID)
+		}
+	}
+	s.mu.Unlock()
+	for _, roomID := range stopped {
+		s.publishTyping(userID, roomID, false)
+	}
+}
+
+// isTyping reports whether userID is typing in roomID on any connection.
+// The caller must hold s.mu.
+func (s *Server) isTyping(userID, roomID string) bool {
+	for conn := range s.sessions[userID] {
+		if _, ok := s.typing[typingKey{ws: conn, userID: userID, roomID: roomID}]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) publishTyping(userID, roomID string, typing bool) {
+	s.BroadcastEvent(roomID, userID, model.Event{
+		Event:     "typing",
+		RoomID:    roomID,
+		UserID:    userID,
+		Data:      model.TypingData{Typing: typing},
+		Timestamp: time.Now().Unix(),
+	})
+}